@@ -51,6 +51,22 @@ func main() {
 		}()
 	}
 
+	// admin API (optional), apart from metrics so that it can stay private
+	var adminSrv *http.Server
+	if cfg.Admin.Addr != "" {
+		adminSrv = &http.Server{
+			Addr:              cfg.Admin.Addr,
+			Handler:           p.AdminHandler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Infof("admin listening on %s, auth=%t", cfg.Admin.Addr, cfg.Admin.AuthEnabled())
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("admin server error: %v", err)
+			}
+		}()
+	}
+
 	// main proxy server
 	go func() {
 		if err := p.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -72,4 +88,7 @@ func main() {
 	if metricsSrv != nil {
 		_ = metricsSrv.Shutdown(ctx)
 	}
+	if adminSrv != nil {
+		_ = adminSrv.Shutdown(ctx)
+	}
 }
@@ -9,7 +9,11 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/fumiama/terasu v0.0.0-20251006080703-541b84ca4a5f
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/fumiama/terasu v0.0.0-20251006080703-541b84ca4a5f
+	github.com/klauspost/compress v1.17.9
+)
 
 require (
 	github.com/FloatTech/ttl v0.0.0-20250224045156-012b1463287d // indirect
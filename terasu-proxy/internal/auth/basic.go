@@ -1,6 +1,7 @@
 package auth
 
 import (
+    "crypto/subtle"
     "net/http"
 )
 
@@ -15,7 +16,26 @@ func (b Basic) Check(r *http.Request) bool {
     u, p, ok := r.BasicAuth()
     if !ok { return false }
     if b.Username == "" && b.Password == "" { return true }
-    return u == b.Username && p == b.Password
+    return subtle.ConstantTimeCompare([]byte(u), []byte(b.Username)) == 1 &&
+        subtle.ConstantTimeCompare([]byte(p), []byte(b.Password)) == 1
 }
 
+// Require answers 401 to requests that fail Check and passes the rest to h.
+func (b Basic) Require(realm string, h http.Handler) http.Handler {
+    if !b.Enabled { return h }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !b.Check(r) {
+            w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
 
+// User returns the username accepted by Check, or "" when auth is off.
+func (b Basic) User(r *http.Request) string {
+    if !b.Enabled { return "" }
+    u, _, _ := r.BasicAuth()
+    return u
+}
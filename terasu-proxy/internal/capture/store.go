@@ -0,0 +1,262 @@
+// Package capture records full HTTP exchanges for HAR export. Bodies are
+// spilled to files so that memory only holds metadata.
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/har"
+	"terasu-proxy/internal/rewrite"
+	"terasu-proxy/internal/rules"
+)
+
+// Store keeps the most recent captured exchanges.
+type Store struct {
+	dir     string
+	maxBody int64
+	max     int
+
+	mu      sync.Mutex
+	records []*record
+}
+
+type record struct {
+	id       uint64
+	replayOf uint64
+	host     string
+	client   Client
+	entry    har.Entry
+	// bodies on disk, empty when there was none
+	reqFile, respFile string
+	reqCut, respCut   bool // bodies cut at maxBody
+}
+
+// partSuffix names bodies still being captured.
+const partSuffix = ".part"
+
+// New prepares the body directory, removing bodies left by earlier runs.
+func New(c config.Capture) (*Store, error) {
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("capture: %w", err)
+	}
+	for _, pattern := range []string{"*.body", "*" + partSuffix} {
+		old, _ := filepath.Glob(filepath.Join(c.Dir, pattern))
+		for _, f := range old {
+			_ = os.Remove(f)
+		}
+	}
+	return &Store{dir: c.Dir, maxBody: c.MaxBody, max: c.MaxEntries}, nil
+}
+
+// add stores an exchange and its bodies under its flow id, evicting the
+// oldest beyond the limit.
+func (s *Store) add(id uint64, host string, c Client, replayOf uint64, e har.Entry, reqBody, respBody *spool) uint64 {
+	if id == 0 {
+		id = flow.NewID()
+	}
+	r := &record{id: id, replayOf: replayOf, host: host, client: c, entry: e}
+	r.reqFile, r.reqCut = s.spill(id, "req", reqBody)
+	r.respFile, r.respCut = s.spill(id, "resp", respBody)
+
+	s.mu.Lock()
+	s.records = append(s.records, r)
+	var evicted []*record
+	if s.max > 0 && len(s.records) > s.max {
+		n := len(s.records) - s.max
+		evicted = append(evicted, s.records[:n]...)
+		s.records = append(s.records[:0:0], s.records[n:]...)
+	}
+	s.mu.Unlock()
+	for _, r := range evicted {
+		r.remove()
+	}
+	return id
+}
+
+// Flow summarizes a captured exchange.
+type Flow struct {
+	ID       uint64    `json:"id"`
+	ReplayOf uint64    `json:"replay_of,omitempty"`
+	Started  time.Time `json:"started"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Status   int       `json:"status"`
+	Ms       float64   `json:"ms"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Flows lists the exchanges for host (suffix match, empty for all), oldest first.
+func (s *Store) Flows(host string) []Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Flow{}
+	for _, r := range s.records {
+		if host != "" && !rules.HostMatches(r.host, []string{strings.ToLower(host)}) {
+			continue
+		}
+		out = append(out, Flow{ID: r.id, ReplayOf: r.replayOf, Started: r.entry.StartedDateTime,
+			Method: r.entry.Request.Method, URL: r.entry.Request.URL, Status: r.entry.Response.Status,
+			Ms: r.entry.Time, Error: r.entry.Comment})
+	}
+	return out
+}
+
+// Request is a captured request as sent upstream.
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	// Truncated is set when the body was cut at max_body and Body is partial.
+	Truncated bool
+	Client    Client
+}
+
+// Request returns the request of flow id, or false when it is not kept.
+func (s *Store) Request(id uint64) (*Request, bool) {
+	s.mu.Lock()
+	var r *record
+	for _, rec := range s.records {
+		if rec.id == id {
+			r = rec
+			break
+		}
+	}
+	s.mu.Unlock()
+	if r == nil {
+		return nil, false
+	}
+	out := &Request{Method: r.entry.Request.Method, URL: r.entry.Request.URL, Header: make(http.Header), Truncated: r.reqCut, Client: r.client}
+	for _, h := range r.entry.Request.Headers {
+		// Host is recorded as a header but set from the URL again
+		if !strings.EqualFold(h.Name, "Host") {
+			out.Header.Add(h.Name, h.Value)
+		}
+	}
+	if r.reqFile != "" {
+		p, err := os.ReadFile(r.reqFile)
+		if err != nil {
+			return nil, false
+		}
+		out.Body = p
+	}
+	return out, true
+}
+
+// spool starts the capture of a body, kept on disk as it is read.
+func (s *Store) spool() *spool {
+	return &spool{dir: s.dir, max: s.maxBody}
+}
+
+func (s *Store) spill(id uint64, kind string, b *spool) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	return b.save(filepath.Join(s.dir, fmt.Sprintf("%d.%s.body", id, kind)))
+}
+
+func (r *record) remove() {
+	for _, f := range []string{r.reqFile, r.respFile} {
+		if f != "" {
+			_ = os.Remove(f)
+		}
+	}
+}
+
+// WriteHAR streams the exchanges for host (suffix match, empty for all)
+// started at or after since as a HAR 1.2 document.
+func (s *Store) WriteHAR(w io.Writer, host string, since time.Time, creator har.Creator) error {
+	s.mu.Lock()
+	recs := make([]*record, 0, len(s.records))
+	for _, r := range s.records {
+		if (host == "" || rules.HostMatches(r.host, []string{strings.ToLower(host)})) && !r.entry.StartedDateTime.Before(since) {
+			recs = append(recs, r)
+		}
+	}
+	s.mu.Unlock()
+
+	head, _ := json.Marshal(creator)
+	if _, err := fmt.Fprintf(w, `{"log":{"version":"1.2","creator":%s,"entries":[`, head); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i, r := range recs {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(r.withBodies()); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}}\n")
+	return err
+}
+
+// withBodies returns the entry with bodies read back from disk. Complete
+// response bodies are stored decoded, as HAR content expects.
+func (r *record) withBodies() har.Entry {
+	e := r.entry
+	e.ID = strconv.FormatUint(r.id, 10)
+	if r.replayOf != 0 {
+		e.ReplayOf = strconv.FormatUint(r.replayOf, 10)
+	}
+	if r.reqFile != "" && e.Request.PostData != nil {
+		pd := *e.Request.PostData
+		if p, err := os.ReadFile(r.reqFile); err == nil {
+			pd.Text, pd.Encoding = text(p)
+		}
+		if r.reqCut {
+			pd.Comment = "truncated"
+		}
+		e.Request.PostData = &pd
+	}
+	if r.respFile != "" {
+		c := &e.Response.Content
+		if p, err := os.ReadFile(r.respFile); err == nil {
+			if enc := headerValue(e.Response.Headers, "Content-Encoding"); enc != "" && !r.respCut {
+				if d, err := rewrite.Decode(enc, p, 64<<20); err == nil {
+					c.Compression = int64(len(d) - len(p))
+					p = d
+				}
+			}
+			c.Size = int64(len(p))
+			c.Text, c.Encoding = text(p)
+		}
+		if r.respCut {
+			c.Size = e.Response.BodySize
+			c.Comment = "truncated"
+		}
+	}
+	return e
+}
+
+func text(p []byte) (string, string) {
+	if utf8.Valid(p) {
+		return string(p), ""
+	}
+	return base64.StdEncoding.EncodeToString(p), "base64"
+}
+
+func headerValue(hs []har.NameValue, name string) string {
+	for _, h := range hs {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
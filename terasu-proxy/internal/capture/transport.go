@@ -0,0 +1,304 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/har"
+	"terasu-proxy/internal/metrics"
+)
+
+type enabledKey struct{}
+
+// Enable marks a request context for capture.
+func Enable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, enabledKey{}, true)
+}
+
+func enabled(ctx context.Context) bool {
+	on, _ := ctx.Value(enabledKey{}).(bool)
+	return on || ctx.Value(replayKey{}) != nil
+}
+
+// Client is who sent a captured request, kept so that replays expand
+// ${client_ip} and ${user} as the original did.
+type Client struct {
+	IP, User string
+}
+
+type clientKey struct{}
+
+// WithClient records the client of the request of ctx for capture.
+func WithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+type replayKey struct{}
+
+type replay struct {
+	of     uint64
+	stored func(id uint64)
+}
+
+// ReplayOf returns the flow replayed by the request of ctx, or 0.
+func ReplayOf(ctx context.Context) uint64 {
+	if rp, _ := ctx.Value(replayKey{}).(*replay); rp != nil {
+		return rp.of
+	}
+	return 0
+}
+
+// Replay marks a request context as a replay of flow of. The request is
+// captured whatever the rules say, and stored is called with its flow id.
+func Replay(ctx context.Context, of uint64, stored func(id uint64)) context.Context {
+	return context.WithValue(ctx, replayKey{}, &replay{of: of, stored: stored})
+}
+
+// Transport records the exchanges of requests marked by Enable. The entry
+// is stored once the response body is closed.
+type Transport struct {
+	Base  http.RoundTripper
+	Store *Store
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Store == nil || !enabled(req.Context()) {
+		return t.Base.RoundTrip(req)
+	}
+	start := time.Now()
+	ctx, tm := metrics.WithTimer(req.Context())
+	req = req.WithContext(ctx)
+	var reqBody *spool
+	if req.Body != nil && req.Body != http.NoBody {
+		reqBody = t.Store.spool()
+		req.Body = &teeBody{ReadCloser: req.Body, buf: reqBody}
+	}
+	e := har.Entry{StartedDateTime: start.UTC(), Request: harRequest(req)}
+	resp, err := t.Base.RoundTrip(req)
+	wait := time.Since(start)
+	if err != nil {
+		e.Time = ms(wait)
+		e.Timings = timings(tm.Timing(), wait, 0)
+		e.Response = har.Response{HTTPVersion: req.Proto, Cookies: []har.NameValue{}, Headers: []har.NameValue{}, HeadersSize: -1, BodySize: -1}
+		e.Comment = err.Error()
+		t.finish(req, e, tm, reqBody, nil)
+		return nil, err
+	}
+	e.Response = harResponse(resp)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the body is the upgraded connection and must stay writable
+		e.Time = ms(wait)
+		e.Timings = timings(tm.Timing(), wait, 0)
+		t.finish(req, e, tm, reqBody, nil)
+		return resp, nil
+	}
+	respBody := t.Store.spool()
+	resp.Body = &teeBody{ReadCloser: resp.Body, buf: respBody, onClose: func() {
+		total := time.Since(start)
+		e.Time = ms(total)
+		e.Timings = timings(tm.Timing(), wait, total-wait)
+		e.Response.BodySize = respBody.size()
+		t.finish(req, e, tm, reqBody, respBody)
+	}}
+	return resp, nil
+}
+
+// timings splits the time to the response headers, wait, into the phases
+// measured by the egress client; HAR counts ssl within connect, and wait
+// is what is left after setup and send.
+func timings(tm *metrics.Timing, wait, receive time.Duration) har.Timings {
+	t := har.Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: ms(wait), Receive: ms(receive)}
+	if tm == nil {
+		return t
+	}
+	var setup float64
+	if tm.DNS > 0 {
+		t.DNS = tm.DNS
+		setup += tm.DNS
+	}
+	if tm.Connect > 0 || tm.TLS > 0 {
+		t.Connect = tm.Connect + tm.TLS
+		setup += t.Connect
+	}
+	if tm.TLS > 0 {
+		t.SSL = tm.TLS
+	}
+	t.Send = tm.Send
+	setup += tm.Send
+	t.Wait = math.Max(0, math.Round((t.Wait-setup)*1000)/1000)
+	return t
+}
+
+// finish stores the entry, completed with the server address and the
+// client connection of the flow, along with the client.
+func (t *Transport) finish(req *http.Request, e har.Entry, tm *metrics.Timer, reqBody, respBody *spool) {
+	if reqBody != nil {
+		e.Request.BodySize = reqBody.size()
+	}
+	if ti := tm.Timing(); ti != nil {
+		e.ServerIPAddress = ti.IP
+	}
+	f := flow.From(req.Context())
+	if f != nil {
+		e.Connection = f.State().Conn
+	}
+	fid := f.ID()
+	c, _ := req.Context().Value(clientKey{}).(Client)
+	rp, _ := req.Context().Value(replayKey{}).(*replay)
+	if rp == nil {
+		t.Store.add(fid, req.URL.Hostname(), c, 0, e, reqBody, respBody)
+		return
+	}
+	id := t.Store.add(fid, req.URL.Hostname(), c, rp.of, e, reqBody, respBody)
+	if rp.stored != nil {
+		rp.stored(id)
+	}
+}
+
+func harRequest(req *http.Request) har.Request {
+	r := har.Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []har.NameValue{},
+		Headers:     []har.NameValue{{Name: "Host", Value: req.Host}},
+		QueryString: []har.NameValue{},
+		HeadersSize: -1,
+	}
+	r.Headers = appendHeaders(r.Headers, req.Header)
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, har.NameValue{Name: c.Name, Value: c.Value})
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			r.QueryString = append(r.QueryString, har.NameValue{Name: k, Value: v})
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r.PostData = &har.PostData{MimeType: req.Header.Get("Content-Type")}
+	}
+	return r
+}
+
+func harResponse(resp *http.Response) har.Response {
+	r := har.Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []har.NameValue{},
+		Headers:     appendHeaders(nil, resp.Header),
+		Content:     har.Content{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+	for _, c := range resp.Cookies() {
+		r.Cookies = append(r.Cookies, har.NameValue{Name: c.Name, Value: c.Value})
+	}
+	return r
+}
+
+func appendHeaders(out []har.NameValue, h http.Header) []har.NameValue {
+	if out == nil {
+		out = []har.NameValue{}
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			out = append(out, har.NameValue{Name: k, Value: v})
+		}
+	}
+	return out
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+// spool writes the first max bytes of a body to a temporary file in dir
+// and counts all of them. Write errors drop what was kept.
+type spool struct {
+	dir string
+	max int64
+
+	mu   sync.Mutex
+	f    *os.File
+	kept int64
+	n    int64
+	err  error
+}
+
+func (b *spool) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.n += int64(len(p))
+	room := b.max - b.kept
+	if room <= 0 || len(p) == 0 || b.err != nil {
+		return
+	}
+	if int64(len(p)) > room {
+		p = p[:room]
+	}
+	if b.f == nil {
+		if b.f, b.err = os.CreateTemp(b.dir, "*"+partSuffix); b.err != nil {
+			return
+		}
+	}
+	n, err := b.f.Write(p)
+	b.kept += int64(n)
+	b.err = err
+}
+
+func (b *spool) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// save moves the kept bytes to name, reporting whether the body was cut.
+// It returns "" when nothing was kept.
+func (b *spool) save(name string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.f == nil {
+		return "", false
+	}
+	tmp := b.f.Name()
+	err := b.f.Close()
+	b.f = nil
+	if b.err != nil || err != nil {
+		_ = os.Remove(tmp)
+		return "", false
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return "", false
+	}
+	// later writes, from a body still being sent, are not kept
+	b.err = os.ErrClosed
+	return name, b.n > b.kept
+}
+
+// teeBody copies what is read from a body into a buffer.
+type teeBody struct {
+	io.ReadCloser
+	buf     *spool
+	once    sync.Once
+	onClose func()
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return err
+}
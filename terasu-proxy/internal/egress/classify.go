@@ -0,0 +1,59 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Error classes reported in events for failed upstream round trips and
+// tunnel dials.
+const (
+	ClassDNS      = "dns"
+	ClassRefused  = "refused"
+	ClassConnect  = "connect" // other dial failures, e.g. unreachable
+	ClassReset    = "reset"
+	ClassTimeout  = "timeout"
+	ClassTLS      = "tls"      // handshake failure
+	ClassFragment = "fragment" // handshake failure after a terasu fragmented attempt
+	ClassVerify   = "verify"   // certificate verification failure
+	ClassCircuit  = "circuit"  // circuit breaker open
+	ClassCanceled = "canceled"
+	ClassOther    = "other"
+)
+
+// Classify returns the class of an upstream error, or "" for nil.
+func Classify(err error) string {
+	var he *HandshakeError
+	var de *net.DNSError
+	var ne net.Error
+	var oe *net.OpError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.Is(err, ErrCircuitOpen):
+		return ClassCircuit
+	case isVerifyError(err):
+		return ClassVerify
+	case errors.As(err, &he):
+		if he.Fragmented {
+			return ClassFragment
+		}
+		return ClassTLS
+	case errors.As(err, &de), errors.Is(err, errEmptyHostAddress):
+		return ClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ClassRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return ClassReset
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return ClassTimeout
+	case errors.As(err, &oe) && oe.Op == "dial":
+		return ClassConnect
+	}
+	return ClassOther
+}
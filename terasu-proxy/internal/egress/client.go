@@ -3,99 +3,435 @@ package egress
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fumiama/terasu"
-	trshttp "github.com/fumiama/terasu/http"
+	"github.com/fumiama/terasu/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/keylog"
+	"terasu-proxy/internal/metrics"
+	"terasu-proxy/internal/tracing"
 )
 
 var defaultDialer = net.Dialer{Timeout: 10 * time.Second}
 
-// Transport selects transport according to dns mode.
-func Transport(dnsMode string) http.RoundTripper {
+var errEmptyHostAddress = errors.New("empty host addr")
+
+// Client is the upstream RoundTripper. It resolves hosts according to the dns
+// mode and performs the terasu fragmented TLS handshake with the trust policy
+// from upstream_tls, falling back to a normal handshake. Connections go
+// through the parent proxies chosen by the request Route.
+type Client struct {
+	log      *logrus.Logger
+	lookup   func(ctx context.Context, host string) ([]string, error)
+	resolver string // reported in request timings
+	tls      *tlsPolicy
+	parents  map[string]*parent
+	envProxy func(*url.URL) (*url.URL, error)
+	done     chan struct{}
+	poolCfg  config.UpstreamPool
+	agg      *metrics.Aggregator
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+	envParents map[string]*parent
+
+	verifyMu sync.Mutex
+	verified map[string]verifyResult
+}
+
+// connector opens one candidate stream to the target.
+type connector func(ctx context.Context) (net.Conn, error)
+
+// New builds the egress client from config. Pool gauges are published to agg
+// when it is not nil.
+func New(cfg *config.Config, log *logrus.Logger, agg *metrics.Aggregator) (*Client, error) {
+	pol, err := newTLSPolicy(cfg.UpstreamTLS, log)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		log:        log,
+		lookup:     lookupFunc(cfg.DNS.Mode),
+		resolver:   resolverName(cfg.DNS.Mode),
+		tls:        pol,
+		parents:    make(map[string]*parent),
+		envProxy:   httpproxy.FromEnvironment().ProxyFunc(),
+		done:       make(chan struct{}),
+		poolCfg:    cfg.UpstreamPool,
+		agg:        agg,
+		transports: make(map[string]*http.Transport),
+		envParents: make(map[string]*parent),
+		verified:   make(map[string]verifyResult),
+	}
+	for _, pc := range cfg.ParentProxies.List {
+		if pc.Name == "" || pc.Name == directParent {
+			return nil, fmt.Errorf("parent proxy: invalid name %q", pc.Name)
+		}
+		p, err := newParent(pc)
+		if err != nil {
+			return nil, err
+		}
+		c.parents[pc.Name] = p
+	}
+	for _, r := range cfg.Rules {
+		for _, name := range r.Parents {
+			if _, ok := c.parents[name]; !ok && name != directParent {
+				return nil, fmt.Errorf("rule %q: unknown parent proxy %q", r.Name, name)
+			}
+		}
+	}
+	if len(c.parents) > 0 && cfg.ParentProxies.HealthInterval > 0 {
+		go c.healthLoop(cfg.ParentProxies.HealthInterval, cfg.ParentProxies.HealthTimeout)
+	}
+	return c, nil
+}
+
+func (c *Client) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := RouteFrom(req.Context())
+	if r.Fragment.Enabled && req.URL.Scheme == "http" {
+		return c.acquire(req, func(req *http.Request) (*http.Response, error) {
+			return c.roundTripFragmented(req, r)
+		})
+	}
+	return c.acquire(req, func(req *http.Request) (*http.Response, error) {
+		return c.send(req, r)
+	})
+}
+
+// Dial opens a raw TCP stream to addr honoring the Route in ctx, for tunnels.
+func (c *Client) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.dialer(RouteFrom(ctx), "https")(ctx, network, addr)
+}
+
+// Close stops health checks and drops idle upstream connections.
+func (c *Client) Close() {
+	close(c.done)
+	c.mu.Lock()
+	for _, t := range c.transports {
+		t.CloseIdleConnections()
+	}
+	c.mu.Unlock()
+}
+
+// transport returns the pooled transport dedicated to a route.
+func (c *Client) transport(r Route) *http.Transport {
+	k := r.key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.transports[k]; ok {
+		return t
+	}
+	dial := c.pooledDialer(c.dialer(r, "http"))
+	if r.Fragment.Enabled {
+		dial = fragmentDialer(dial, r.Fragment)
+	}
+	t := &http.Transport{
+		DialContext:           dial,
+		DialTLSContext:        c.tlsDialer(r),
+		ForceAttemptHTTP2:     true,
+		MaxConnsPerHost:       c.poolCfg.MaxConnsPerHost,
+		MaxIdleConns:          c.poolCfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.poolCfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.poolCfg.IdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	c.transports[k] = t
+	return t
+}
+
+// send sends req on a route. Plain HTTP through an HTTP parent goes to the
+// parent in absolute form rather than through a CONNECT tunnel, which many
+// proxies only allow to port 443; when the parent cannot be reached, the
+// remaining candidates are tried.
+func (c *Client) send(req *http.Request, r Route) (*http.Response, error) {
+	p, rest := c.httpParent(r, req.URL)
+	if p == nil {
+		return c.transport(r).RoundTrip(req)
+	}
+	if rest == nil {
+		return c.proxyTransport(r, p).RoundTrip(req)
+	}
+	var got atomic.Bool
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { got.Store(true) },
+	})
+	first := req.WithContext(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		// nothing is read before a connection, so the body can go to the next
+		// candidate if the transport closes it after a failed dial
+		first.Body = &dialBody{ReadCloser: req.Body, got: &got}
+	}
+	resp, err := c.proxyTransport(r, p).RoundTrip(first)
+	if err == nil || got.Load() || req.Context().Err() != nil {
+		return resp, err
+	}
+	c.log.Debugf("parent proxy %s: %v, trying the next", p.name, err)
+	return c.send(req, *rest)
+}
+
+// dialBody is a request body that stays open when closed before the
+// transport got a connection.
+type dialBody struct {
+	io.ReadCloser
+	got *atomic.Bool
+}
+
+func (b *dialBody) Close() error {
+	if !b.got.Load() {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// proxyTransport returns the pooled transport that forwards plain-HTTP
+// requests to the parent p.
+func (c *Client) proxyTransport(r Route, p *parent) *http.Transport {
+	k := "via " + p.url.String() + Route{Fragment: r.Fragment}.key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.transports[k]; ok {
+		return t
+	}
+	dial := c.pooledDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := defaultDialer.DialContext(ctx, network, addr)
+		metrics.TimerFrom(ctx).Update(func(t *metrics.Timing) {
+			t.Connect, t.Resolver = metrics.Since(start), "parent "+p.name
+		})
+		tracing.Record(ctx, "connect "+addr, start, err, "terasu.parent", p.name)
+		return conn, err
+	})
+	if r.Fragment.Enabled {
+		dial = fragmentDialer(dial, r.Fragment)
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyURL(p.url),
+		DialContext:           dial,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		MaxConnsPerHost:       c.poolCfg.MaxConnsPerHost,
+		MaxIdleConns:          c.poolCfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.poolCfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.poolCfg.IdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	c.transports[k] = t
+	return t
+}
+
+// lookupFunc selects the resolver according to dns mode.
+func lookupFunc(dnsMode string) func(ctx context.Context, host string) ([]string, error) {
 	switch dnsMode {
 	case "system":
-		return newSystemDNSTransport()
+		return net.DefaultResolver.LookupHost
 	case "terasu", "auto":
 		fallthrough
 	default:
-		return trshttp.DefaultClient.Transport
+		return dns.LookupHost
+	}
+}
+
+func resolverName(dnsMode string) string {
+	if dnsMode == "system" {
+		return "system"
+	}
+	return "terasu"
+}
+
+// connectors lists the ways to reach addr for a route: every resolved
+// address for direct candidates, one entry per parent proxy otherwise.
+// Route.Connect replaces the dialed address.
+func (c *Client) connectors(ctx context.Context, r Route, scheme, network, addr string) ([]connector, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.Connect != "" {
+		if h, p, err := net.SplitHostPort(r.Connect); err == nil {
+			host, port = h, p
+		} else {
+			host = r.Connect
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	var out []connector
+	var lastErr error
+	for _, p := range c.candidates(r, scheme, addr) {
+		if p != nil {
+			p := p
+			out = append(out, func(ctx context.Context) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, defaultDialer.Timeout)
+				defer cancel()
+				start := time.Now()
+				conn, err := p.dial(ctx, addr)
+				metrics.TimerFrom(ctx).Update(func(t *metrics.Timing) {
+					t.Connect, t.Resolver = metrics.Since(start), "parent "+p.name
+				})
+				tracing.Record(ctx, "connect "+addr, start, err, "terasu.parent", p.name)
+				return conn, err
+			})
+			continue
+		}
+		start := time.Now()
+		addrs, err := c.lookup(ctx, host)
+		metrics.TimerFrom(ctx).Update(func(t *metrics.Timing) { t.DNS, t.Resolver = metrics.Since(start), c.resolver })
+		tracing.Record(ctx, "dns "+host, start, err, "terasu.resolver", c.resolver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, a := range addrs {
+			target := net.JoinHostPort(a, port)
+			out = append(out, func(ctx context.Context) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, defaultDialer.Timeout)
+				defer cancel()
+				start := time.Now()
+				conn, err := defaultDialer.DialContext(ctx, network, target)
+				metrics.TimerFrom(ctx).Update(func(t *metrics.Timing) { t.Connect = metrics.Since(start) })
+				tracing.Record(ctx, "connect "+target, start, err, "network.peer.address", target)
+				return conn, err
+			})
+		}
+	}
+	if len(out) == 0 {
+		if lastErr == nil {
+			lastErr = errEmptyHostAddress
+		}
+		return nil, lastErr
+	}
+	return out, nil
+}
+
+// dialer returns a plain TCP dial function for a route. scheme selects the
+// proxy environment variable consulted when the route has no parents.
+func (c *Client) dialer(r Route, scheme string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conns, err := c.connectors(ctx, r, scheme, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, connect := range conns {
+			var conn net.Conn
+			if conn, err = connect(ctx); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
 	}
 }
 
-// newSystemDNSTransport builds an http.Transport that resolves via system DNS
-// while keeping terasu TLS handshake behavior.
-func newSystemDNSTransport() http.RoundTripper {
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			host, port, err := net.SplitHostPort(addr)
-			if err != nil {
+// tlsDialer returns a TLS dial function for a route. Every candidate is
+// tried first with a terasu handshake and then with a normal one.
+// Certificate verification failures are final, and remembered for
+// VerifyFailure.
+func (c *Client) tlsDialer(r Route) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		g := c.pool(host)
+		g.DialStart()
+		ok := false
+		defer func() { g.DialDone(ok) }()
+		conns, err := c.connectors(ctx, r, "https", network, addr)
+		if err != nil {
+			return nil, err
+		}
+		fragment := terasu.DefaultFirstFragmentLen > 0
+		for _, connect := range conns {
+			connect := pooledConnector(connect, g)
+			var conn *tls.Conn
+			conn, err = c.handshake(ctx, connect, host, r, fragment)
+			if err == nil {
+				ok = true
+				c.noteVerify(addr, nil)
+				return conn, nil
+			}
+			if isVerifyError(err) {
+				c.noteVerify(addr, err)
 				return nil, err
 			}
-			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
-			if err != nil {
+			// retry with normal handshake
+			conn, err = c.handshake(ctx, connect, host, r, false)
+			if err == nil {
+				ok = true
+				c.noteVerify(addr, nil)
+				return conn, nil
+			}
+			if isVerifyError(err) {
+				c.noteVerify(addr, err)
 				return nil, err
 			}
-			var conn net.Conn
-			var tlsConn *tls.Conn
-			for _, a := range addrs {
-				// establish TCP
-				if defaultDialer.Timeout != 0 {
-					var cancel context.CancelFunc
-					ctx, cancel = context.WithTimeout(context.Background(), defaultDialer.Timeout)
-					defer cancel()
-				} else if !defaultDialer.Deadline.IsZero() {
-					var cancel context.CancelFunc
-					ctx, cancel = context.WithDeadline(context.Background(), defaultDialer.Deadline)
-					defer cancel()
-				}
-				conn, err = defaultDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
-				if err != nil {
-					continue
-				}
-				tlsConn = tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
-				// re-init ctx due to deadline settings in tcp dial
-				if defaultDialer.Timeout != 0 {
-					var cancel context.CancelFunc
-					ctx, cancel = context.WithTimeout(context.Background(), defaultDialer.Timeout)
-					defer cancel()
-				} else if !defaultDialer.Deadline.IsZero() {
-					var cancel context.CancelFunc
-					ctx, cancel = context.WithDeadline(context.Background(), defaultDialer.Deadline)
-					defer cancel()
-				}
-				if terasu.DefaultFirstFragmentLen > 0 {
-					err = terasu.Use(tlsConn).HandshakeContext(ctx, terasu.DefaultFirstFragmentLen)
-				} else {
-					err = tlsConn.HandshakeContext(ctx)
-				}
-				if err == nil {
-					break
-				}
-				_ = tlsConn.Close()
-				tlsConn = nil
-				// retry with normal handshake
-				conn, err = defaultDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
-				if err != nil {
-					continue
-				}
-				tlsConn = tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
-				err = tlsConn.HandshakeContext(ctx)
-				if err == nil {
-					break
-				}
-				_ = tlsConn.Close()
-				tlsConn = nil
+			var he *HandshakeError
+			if errors.As(err, &he) {
+				he.Fragmented = fragment
 			}
-			return tlsConn, err
-		},
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+		}
+		return nil, err
+	}
+}
+
+func (c *Client) handshake(ctx context.Context, connect connector, host string, r Route, fragment bool) (*tls.Conn, error) {
+	conn, err := connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.tls.config(host, r)
+	if w := keylog.Writer(ctx, "upstream", host); w != nil {
+		cfg.KeyLogWriter = w
+	}
+	tlsConn := tls.Client(conn, cfg)
+	hctx, cancel := context.WithTimeout(ctx, defaultDialer.Timeout)
+	defer cancel()
+	start := time.Now()
+	if fragment {
+		err = terasu.Use(tlsConn).HandshakeContext(hctx, terasu.DefaultFirstFragmentLen)
+	} else {
+		err = tlsConn.HandshakeContext(hctx)
+	}
+	tracing.Record(ctx, "tls "+host, start, err, "terasu.fragmented", fragment)
+	if err != nil {
+		_ = tlsConn.Close()
+		if isVerifyError(err) {
+			return nil, err
+		}
+		return nil, &HandshakeError{Err: err}
+	}
+	if pc, ok := conn.(*poolConn); ok {
+		pc.opened()
 	}
+	metrics.TimerFrom(ctx).Update(func(t *metrics.Timing) { t.TLS, t.Fragmented = metrics.Since(start), fragment })
+	return tlsConn, nil
+}
+
+// HandshakeError reports a failed upstream TLS handshake other than a
+// certificate verification failure.
+type HandshakeError struct {
+	Err error
+	// Fragmented is set when the terasu fragmented handshake was tried and
+	// failed before the normal handshake that produced Err.
+	Fragmented bool
+}
+
+func (e *HandshakeError) Error() string { return "tls handshake: " + e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+func isVerifyError(err error) bool {
+	_, ok := VerifyError(err)
+	return ok
 }
@@ -0,0 +1,213 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPFragment controls plain-HTTP request fragmentation for a route.
+type HTTPFragment struct {
+	Enabled bool
+	MixCase bool
+	Delay   time.Duration
+}
+
+var hostHeader = []byte("\r\nHost:")
+
+// fragConn splits each outgoing request head so that the request line and
+// the Host header never travel in a single TCP segment.
+type fragConn struct {
+	net.Conn
+	opt HTTPFragment
+
+	mu        sync.Mutex
+	deadline  time.Time // for writes, which also bounds the delays
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func fragmentDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), opt HTTPFragment) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetNoDelay(true)
+		}
+		return &fragConn{Conn: conn, opt: opt, closed: make(chan struct{})}, nil
+	}
+}
+
+func (c *fragConn) Write(p []byte) (int, error) {
+	cuts := requestCuts(p)
+	if cuts == nil {
+		return c.Conn.Write(p)
+	}
+	if c.opt.MixCase {
+		// p belongs to the transport's buffer; rewrite a copy
+		p = append([]byte(nil), p...)
+		mixCase(p[cuts[1]-2 : cuts[1]+2])
+	}
+	n, prev := 0, 0
+	for _, cut := range append(cuts, len(p)) {
+		m, err := c.Conn.Write(p[prev:cut])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		prev = cut
+		if c.opt.Delay > 0 && cut < len(p) {
+			if err := c.pause(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// pause waits out the delay between fragments, ending early when the write
+// deadline passes or the connection is closed.
+func (c *fragConn) pause() error {
+	d, late := c.opt.Delay, false
+	c.mu.Lock()
+	if !c.deadline.IsZero() {
+		if left := time.Until(c.deadline); left < d {
+			d, late = left, true
+		}
+	}
+	c.mu.Unlock()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		if late {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *fragConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *fragConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *fragConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// requestCuts returns split offsets inside the request line, the Host header
+// name and the Host value, or nil when p does not start a request head.
+func requestCuts(p []byte) []int {
+	sp := bytes.IndexByte(p, ' ')
+	if sp <= 0 || sp > 16 {
+		return nil
+	}
+	head := p
+	if end := bytes.Index(p, []byte("\r\n\r\n")); end >= 0 {
+		head = p[:end+2]
+	}
+	lineEnd := bytes.Index(head, []byte("\r\n"))
+	h := bytes.Index(head, hostHeader)
+	if lineEnd < 0 || h < 0 {
+		return nil
+	}
+	name := h + 2 // start of "Host"
+	valEnd := len(head)
+	if i := bytes.Index(head[name:], []byte("\r\n")); i >= 0 {
+		valEnd = name + i
+	}
+	val := name + len("Host:")
+	return []int{
+		sp + 1 + (lineEnd-sp-1)/2, // middle of the request target
+		name + 2,                  // "Ho" | "st:"
+		val + (valEnd-val+1)/2,    // middle of the host value
+	}
+}
+
+// mixCase randomizes the letter case of b in place.
+func mixCase(b []byte) {
+	for i, ch := range b {
+		if rand.Intn(2) == 0 {
+			continue
+		}
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			b[i] = ch - 'a' + 'A'
+		case ch >= 'A' && ch <= 'Z':
+			b[i] = ch - 'A' + 'a'
+		}
+	}
+}
+
+// roundTripFragmented sends a plain-HTTP request over a fragmenting
+// transport and falls back to a normal send when the server resets the
+// connection or rejects the request as malformed.
+func (c *Client) roundTripFragmented(req *http.Request, r Route) (*http.Response, error) {
+	var wrote atomic.Bool
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				wrote.Store(true)
+			}
+		},
+	})
+	resp, err := c.send(req.WithContext(ctx), r)
+	if !fragmentFallback(req, resp, err, wrote.Load()) {
+		return resp, err
+	}
+	if err == nil {
+		_ = resp.Body.Close()
+		c.log.Debugf("http fragment: %s answered 400, resending unfragmented", req.URL.Host)
+	} else {
+		c.log.Debugf("http fragment: %s: %v, resending unfragmented", req.URL.Host, err)
+	}
+	req, err = rewind(req)
+	if err != nil {
+		return nil, err
+	}
+	r.Fragment = HTTPFragment{}
+	return c.send(req, r)
+}
+
+// fragmentFallback reports whether a fragmented attempt that got resp or
+// err should be sent again unfragmented. Idempotent requests are resent
+// after a failure or a 400; others only when the request was not written
+// in full, so that the server cannot have acted on it.
+func fragmentFallback(req *http.Request, resp *http.Response, err error, wrote bool) bool {
+	if err == nil && resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+	if retryable(req) {
+		return true
+	}
+	return err != nil && !wrote && replayable(req)
+}
+
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,105 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestCuts(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string // fragments; nil when p is left whole
+	}{
+		{
+			name: "request head",
+			in:   "GET /abc HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			want: []string{"GET /abc H", "TTP/1.1\r\nHo", "st: examp", "le.com\r\n\r\n"},
+		},
+		{
+			name: "host after other headers",
+			in:   "POST /f HTTP/1.1\r\nUser-Agent: x\r\nHost: a.test\r\n\r\nbody",
+			want: []string{"POST /f HT", "TP/1.1\r\nUser-Agent: x\r\nHo", "st: a.t", "est\r\n\r\nbody"},
+		},
+		{
+			name: "body with a host line",
+			in:   "GET / HTTP/1.1\r\n\r\nx\r\nHost: a.test\r\n",
+		},
+		{
+			name: "not a request",
+			in:   "hello world without crlf",
+		},
+		{
+			name: "body chunk",
+			in:   "0123456789abcdefghij klmn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := []byte(tt.in)
+			cuts := requestCuts(p)
+			var got []string
+			if cuts != nil {
+				prev := 0
+				for _, cut := range append(cuts, len(p)) {
+					got = append(got, string(p[prev:cut]))
+					prev = cut
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fragments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFragmentFallback(t *testing.T) {
+	reset := errors.New("connection reset by peer")
+	ok := &http.Response{StatusCode: http.StatusOK}
+	bad := &http.Response{StatusCode: http.StatusBadRequest}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		method string
+		body   io.Reader
+		noGet  bool // body cannot be resent
+		ctx    context.Context
+		resp   *http.Response
+		err    error
+		wrote  bool
+		want   bool
+	}{
+		{name: "success", method: "GET", resp: ok},
+		{name: "get 400", method: "GET", resp: bad, wrote: true, want: true},
+		{name: "get reset after write", method: "GET", err: reset, wrote: true, want: true},
+		{name: "put reset after write", method: "PUT", body: strings.NewReader("x"), err: reset, wrote: true, want: true},
+		{name: "post 400", method: "POST", body: strings.NewReader("x"), resp: bad, wrote: true},
+		{name: "post reset after write", method: "POST", body: strings.NewReader("x"), err: reset, wrote: true},
+		{name: "post reset before write", method: "POST", body: strings.NewReader("x"), err: reset, want: true},
+		{name: "post body not resendable", method: "POST", body: strings.NewReader("x"), noGet: true, err: reset},
+		{name: "canceled", method: "GET", ctx: canceled, err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://example.com/", tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.noGet {
+				req.GetBody = nil
+			}
+			if tt.ctx != nil {
+				req = req.WithContext(tt.ctx)
+			}
+			if got := fragmentFallback(req, tt.resp, tt.err, tt.wrote); got != tt.want {
+				t.Errorf("fragmentFallback = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"terasu-proxy/internal/config"
+)
+
+// directParent is the reserved parent name that dials the target directly.
+const directParent = "direct"
+
+// parent is an upstream proxy reached via HTTP CONNECT or SOCKS5.
+type parent struct {
+	name    string
+	url     *url.URL
+	check   string
+	healthy atomic.Bool
+}
+
+func newParent(pc config.ParentProxy) (*parent, error) {
+	u, err := url.Parse(pc.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parent proxy %s: %w", pc.Name, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("parent proxy %s: unsupported scheme %q", pc.Name, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("parent proxy %s: missing host", pc.Name)
+	}
+	p := &parent{name: pc.Name, url: u, check: pc.Check}
+	p.healthy.Store(true)
+	return p, nil
+}
+
+func (p *parent) hostport() string {
+	if port := p.url.Port(); port != "" {
+		return p.url.Host
+	}
+	switch p.url.Scheme {
+	case "https":
+		return net.JoinHostPort(p.url.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(p.url.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(p.url.Hostname(), "80")
+	}
+}
+
+// dial opens a TCP stream to addr through the parent.
+func (p *parent) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if p.url.Scheme == "socks5" || p.url.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if u := p.url.User; u != nil {
+			pw, _ := u.Password()
+			auth = &proxy.Auth{User: u.Username(), Password: pw}
+		}
+		d, err := proxy.SOCKS5("tcp", p.hostport(), auth, &defaultDialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+	return p.connect(ctx, addr)
+}
+
+// connect issues an HTTP CONNECT for addr, with Basic auth from the URL.
+func (p *parent) connect(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := defaultDialer.DialContext(ctx, "tcp", p.hostport())
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(defaultDialer.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	if p.url.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: p.url.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := p.url.User; u != nil {
+		pw, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pw)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent proxy %s: CONNECT %s: %s", p.name, addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// probe checks that the parent accepts connections, and tunnels to the
+// check target when one is configured.
+func (p *parent) probe(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if p.check != "" {
+		conn, err = p.dial(ctx, p.check)
+	} else {
+		conn, err = defaultDialer.DialContext(ctx, "tcp", p.hostport())
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// bufferedConn returns bytes read ahead by the CONNECT response parser first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// healthLoop probes all parents until the client is closed.
+func (c *Client) healthLoop(interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for _, p := range c.parents {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := p.probe(ctx)
+			cancel()
+			if up := err == nil; up != p.healthy.Swap(up) {
+				if up {
+					c.log.Infof("parent proxy %s is healthy again", p.name)
+				} else {
+					c.log.Warnf("parent proxy %s is unhealthy: %v", p.name, err)
+				}
+			}
+		}
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// candidates returns the parents to try for addr in order; a nil entry
+// means a direct connection. Unhealthy parents are moved to the end.
+func (c *Client) candidates(r Route, scheme, addr string) []*parent {
+	if len(r.Parents) == 0 {
+		if u, _ := c.envProxy(&url.URL{Scheme: scheme, Host: addr}); u != nil {
+			return []*parent{c.envParent(u)}
+		}
+		return []*parent{nil}
+	}
+	var healthy, down []*parent
+	for _, name := range r.Parents {
+		if name == directParent {
+			healthy = append(healthy, nil)
+			continue
+		}
+		if p := c.parents[name]; p != nil {
+			if p.healthy.Load() {
+				healthy = append(healthy, p)
+			} else {
+				down = append(down, p)
+			}
+		}
+	}
+	return append(healthy, down...)
+}
+
+// httpParent returns the parent that plain-HTTP requests to u are forwarded
+// to in absolute form, or nil when they are dialed directly or tunneled,
+// and a route over the candidates after it, if any. Only HTTP and HTTPS
+// parents forward requests, and a Route.Connect override needs a tunnel to
+// the replaced address.
+func (c *Client) httpParent(r Route, u *url.URL) (*parent, *Route) {
+	if u.Scheme != "http" || r.Connect != "" {
+		return nil, nil
+	}
+	ps := c.candidates(r, "http", u.Host)
+	if len(ps) == 0 || ps[0] == nil {
+		return nil, nil
+	}
+	if s := ps[0].url.Scheme; s != "http" && s != "https" {
+		return nil, nil
+	}
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	rest := r
+	rest.Parents = make([]string, 0, len(ps)-1)
+	for _, p := range ps[1:] {
+		if p == nil {
+			rest.Parents = append(rest.Parents, directParent)
+		} else {
+			rest.Parents = append(rest.Parents, p.name)
+		}
+	}
+	return ps[0], &rest
+}
+
+// envParent returns a parent for a proxy taken from the environment.
+func (c *Client) envParent(u *url.URL) *parent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.envParents[u.String()]; ok {
+		return p
+	}
+	p := &parent{name: "env", url: u}
+	p.healthy.Store(true)
+	c.envParents[u.String()] = p
+	return p
+}
@@ -0,0 +1,92 @@
+package egress
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"terasu-proxy/internal/metrics"
+)
+
+// pool returns the pool gauge of an upstream host.
+func (c *Client) pool(host string) *metrics.PoolGauge {
+	if c.agg == nil {
+		return &metrics.PoolGauge{}
+	}
+	return c.agg.Pool(host)
+}
+
+// poolConn reports its close to the pool gauge once it has been counted open.
+type poolConn struct {
+	net.Conn
+	g    *metrics.PoolGauge
+	live atomic.Bool
+}
+
+// opened marks the connection as part of the pool.
+func (c *poolConn) opened() { c.live.Store(true) }
+
+func (c *poolConn) Close() error {
+	if c.live.Swap(false) {
+		c.g.Closed()
+	}
+	return c.Conn.Close()
+}
+
+// pooledDialer counts dials and open connections of a plain dial function.
+func (c *Client) pooledDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		g := c.pool(host)
+		g.DialStart()
+		conn, err := dial(ctx, network, addr)
+		g.DialDone(err == nil)
+		if err != nil {
+			return nil, err
+		}
+		pc := &poolConn{Conn: conn, g: g}
+		pc.opened()
+		return pc, nil
+	}
+}
+
+// pooledConnector wraps the streams of connect for the pool gauge. They
+// count as open only once the TLS handshake marks them opened.
+func pooledConnector(connect connector, g *metrics.PoolGauge) connector {
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &poolConn{Conn: conn, g: g}, nil
+	}
+}
+
+// acquire counts req as active on its host until the response body is
+// closed or the round trip fails.
+func (c *Client) acquire(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	g := c.pool(req.URL.Hostname())
+	g.Acquire()
+	resp, err := rt(req)
+	// a switched connection is handed over as the body and must stay writable
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		g.Release()
+		return resp, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: g.Release}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
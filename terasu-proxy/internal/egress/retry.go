@@ -0,0 +1,251 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without contacting upstream while the circuit
+// breaker of a host is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Retrier resends idempotent requests after transient failures and keeps a
+// circuit breaker per upstream host.
+type Retrier struct {
+	Base http.RoundTripper
+
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	onErr      map[string]bool
+	onCode     map[int]bool
+
+	failures int
+	openFor  time.Duration
+	agg      *metrics.Aggregator
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	state    string // closed | open | half-open
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// NewRetrier wraps base with the retry and breaker policies. Breaker state
+// changes are published to agg when it is not nil.
+func NewRetrier(base http.RoundTripper, rc config.Retry, bc config.Breaker, agg *metrics.Aggregator) *Retrier {
+	t := &Retrier{
+		Base:       base,
+		attempts:   rc.Attempts,
+		backoff:    rc.Backoff,
+		maxBackoff: rc.MaxBackoff,
+		onErr:      make(map[string]bool),
+		onCode:     make(map[int]bool),
+		failures:   bc.Failures,
+		openFor:    bc.OpenFor,
+		agg:        agg,
+		breakers:   make(map[string]*breaker),
+	}
+	for _, on := range rc.On {
+		if code, err := strconv.Atoi(on); err == nil {
+			t.onCode[code] = true
+		} else {
+			t.onErr[on] = true
+		}
+	}
+	return t
+}
+
+func (t *Retrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if err := t.allow(host); err != nil {
+		return nil, err
+	}
+	attempts := t.attempts
+	if attempts < 1 || !retryable(req) {
+		attempts = 1
+	}
+	delay := t.backoff
+	for i := 0; ; i++ {
+		if i > 0 {
+			n := i
+			metrics.Annotate(req.Context(), func(ev *metrics.RequestEvent) { ev.Retries = n })
+			var err error
+			if req, err = rewind(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := t.Base.RoundTrip(req)
+		failed := t.failed(resp, err)
+		if req.Context().Err() == nil {
+			t.record(host, failed)
+		} else {
+			t.abandon(host)
+		}
+		if !failed || i+1 >= attempts || !t.shouldRetry(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			_ = resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if delay *= 2; t.maxBackoff > 0 && delay > t.maxBackoff {
+			delay = t.maxBackoff
+		}
+		if err := t.allow(host); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// failed reports upstream failures counted by the breaker: transport errors
+// other than cancellation and certificate failures, and 502/503/504.
+func (t *Retrier) failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !isVerifyError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *Retrier) shouldRetry(resp *http.Response, err error) bool {
+	if err == nil {
+		return t.onCode[resp.StatusCode]
+	}
+	return t.onErr[retryKind(err)]
+}
+
+// retryKind maps a round trip error to a retry.on condition.
+func retryKind(err error) string {
+	switch Classify(err) {
+	case ClassTLS, ClassFragment:
+		return "handshake"
+	case ClassReset:
+		return "reset"
+	case ClassTimeout:
+		return "timeout"
+	case ClassDNS, ClassRefused, ClassConnect:
+		return "connect"
+	}
+	return ""
+}
+
+// retryable allows retries for idempotent methods whose body can be resent.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return replayable(req)
+	}
+	return false
+}
+
+// rewind prepares a request for another attempt.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil || req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+// allow fails fast while the circuit of host is open and lets a single
+// probe through once the open period has passed.
+func (t *Retrier) allow(host string) error {
+	if t.failures <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil || b.state == "closed" {
+		return nil
+	}
+	if b.state == "open" && time.Now().After(b.until) {
+		b.state = "half-open"
+		b.probing = false
+		t.publish(host, b)
+	}
+	if b.state == "half-open" && !b.probing {
+		b.probing = true
+		return nil
+	}
+	return ErrCircuitOpen
+}
+
+// record updates the breaker of host with the outcome of an attempt.
+func (t *Retrier) record(host string, failed bool) {
+	if t.failures <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil {
+		if !failed {
+			return
+		}
+		b = &breaker{state: "closed"}
+		t.breakers[host] = b
+	}
+	prev := b.state
+	if !failed {
+		delete(t.breakers, host)
+		if prev != "closed" {
+			b.state, b.failures = "closed", 0
+			t.publish(host, b)
+		}
+		return
+	}
+	b.failures++
+	b.probing = false
+	if b.state == "half-open" || b.failures >= t.failures {
+		b.state = "open"
+		b.until = time.Now().Add(t.openFor)
+	}
+	if b.state != prev || b.state == "open" {
+		t.publish(host, b)
+	}
+}
+
+// abandon releases a half-open probe whose request was canceled.
+func (t *Retrier) abandon(host string) {
+	if t.failures <= 0 {
+		return
+	}
+	t.mu.Lock()
+	if b := t.breakers[host]; b != nil {
+		b.probing = false
+	}
+	t.mu.Unlock()
+}
+
+func (t *Retrier) publish(host string, b *breaker) {
+	if t.agg != nil {
+		t.agg.SetBreaker(host, metrics.BreakerStat{State: b.state, Failures: b.failures, OpenUntil: b.until})
+	}
+}
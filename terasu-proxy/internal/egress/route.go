@@ -0,0 +1,106 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Route carries the per-request egress choices derived from rules. Requests
+// with different routes never share pooled connections.
+type Route struct {
+	// Parents lists parent proxy names tried in order; "direct" dials directly.
+	// Empty falls back to the proxy environment variables.
+	Parents []string
+	// Connect is dialed instead of the request host; a missing port keeps
+	// the request port.
+	Connect string
+	// SNI replaces the TLS server name; NoSNI sends none.
+	SNI   string
+	NoSNI bool
+	// VerifyName is the name the upstream certificate must cover. It
+	// defaults to SNI, then to the request host.
+	VerifyName string
+	// Host replaces the Host header sent upstream. It does not affect dialing.
+	Host string
+	// Fragment splits plain-HTTP request heads across TCP segments.
+	Fragment HTTPFragment
+}
+
+func (r Route) key() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(r.Parents, ","))
+	for _, s := range []string{r.Connect, r.SNI, r.VerifyName} {
+		b.WriteByte('|')
+		b.WriteString(s)
+	}
+	if r.NoSNI {
+		b.WriteString("|nosni")
+	}
+	if f := r.Fragment; f.Enabled {
+		fmt.Fprintf(&b, "|frag:%t:%s", f.MixCase, f.Delay)
+	}
+	return b.String()
+}
+
+// serverName returns the TLS server name to send for host.
+func (r Route) serverName(host string) string {
+	switch {
+	case r.NoSNI:
+		return ""
+	case r.SNI != "":
+		return r.SNI
+	default:
+		return host
+	}
+}
+
+// verifyName returns the name the certificate for host must cover.
+func (r Route) verifyName(host string) string {
+	switch {
+	case r.VerifyName != "":
+		return r.VerifyName
+	case r.SNI != "" && !r.NoSNI:
+		return r.SNI
+	default:
+		return host
+	}
+}
+
+// Overridden reports whether the route changes the upstream address, SNI or Host.
+func (r Route) Overridden() bool {
+	return r.Connect != "" || r.SNI != "" || r.NoSNI || r.VerifyName != "" || r.Host != ""
+}
+
+// String describes the upstream overrides, for logs and events.
+func (r Route) String() string {
+	var parts []string
+	if r.Connect != "" {
+		parts = append(parts, "connect="+r.Connect)
+	}
+	if r.NoSNI {
+		parts = append(parts, "sni=none")
+	} else if r.SNI != "" {
+		parts = append(parts, "sni="+r.SNI)
+	}
+	if r.VerifyName != "" {
+		parts = append(parts, "verify="+r.VerifyName)
+	}
+	if r.Host != "" {
+		parts = append(parts, "host="+r.Host)
+	}
+	return strings.Join(parts, " ")
+}
+
+type routeKey struct{}
+
+// WithRoute attaches a route to a request or dial context.
+func WithRoute(ctx context.Context, r Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, r)
+}
+
+// RouteFrom returns the route stored by WithRoute, or the zero route.
+func RouteFrom(ctx context.Context) Route {
+	r, _ := ctx.Value(routeKey{}).(Route)
+	return r
+}
@@ -0,0 +1,317 @@
+package egress
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/rules"
+)
+
+var errPinMismatch = errors.New("no certificate in chain matches pinned SPKI hashes")
+
+// hostTLS is a compiled upstream_tls.hosts entry.
+type hostTLS struct {
+	suffixes []string
+	roots    *x509.CertPool // nil keeps the global pool
+	insecure bool
+	pins     [][]byte
+	cert     *tls.Certificate
+}
+
+// tlsPolicy builds the client tls.Config used for each upstream host.
+type tlsPolicy struct {
+	roots *x509.CertPool // nil means system roots
+	hosts []hostTLS
+	log   *logrus.Logger
+}
+
+func newTLSPolicy(c config.UpstreamTLS, log *logrus.Logger) (*tlsPolicy, error) {
+	p := &tlsPolicy{log: log}
+	if len(c.CAFiles) > 0 || c.NoSystemRoots {
+		pool, err := basePool(c.NoSystemRoots)
+		if err != nil {
+			return nil, err
+		}
+		if err := appendCAFiles(pool, c.CAFiles); err != nil {
+			return nil, err
+		}
+		p.roots = pool
+	}
+	for i, h := range c.Hosts {
+		ht := hostTLS{insecure: h.InsecureSkipVerify}
+		for _, s := range h.Hosts {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				ht.suffixes = append(ht.suffixes, s)
+			}
+		}
+		if len(ht.suffixes) == 0 {
+			return nil, fmt.Errorf("upstream_tls.hosts[%d]: empty hosts", i)
+		}
+		if len(h.CAFiles) > 0 {
+			var pool *x509.CertPool
+			if p.roots != nil {
+				pool = p.roots.Clone()
+			} else {
+				var err error
+				if pool, err = basePool(false); err != nil {
+					return nil, err
+				}
+			}
+			if err := appendCAFiles(pool, h.CAFiles); err != nil {
+				return nil, fmt.Errorf("upstream_tls.hosts[%d]: %w", i, err)
+			}
+			ht.roots = pool
+		}
+		for _, pin := range h.Pins {
+			d, err := parsePin(pin)
+			if err != nil {
+				return nil, fmt.Errorf("upstream_tls.hosts[%d]: %w", i, err)
+			}
+			ht.pins = append(ht.pins, d)
+		}
+		if h.ClientCert != "" || h.ClientKey != "" {
+			crt, err := tls.LoadX509KeyPair(h.ClientCert, h.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("upstream_tls.hosts[%d]: load client cert: %w", i, err)
+			}
+			ht.cert = &crt
+		}
+		if ht.insecure {
+			log.Warnf("upstream_tls: certificate verification is DISABLED for %v", ht.suffixes)
+		}
+		p.hosts = append(p.hosts, ht)
+	}
+	return p, nil
+}
+
+// lookup returns the first hosts entry matching host, or nil.
+func (p *tlsPolicy) lookup(host string) *hostTLS {
+	for i := range p.hosts {
+		if rules.HostMatches(host, p.hosts[i].suffixes) {
+			return &p.hosts[i]
+		}
+	}
+	return nil
+}
+
+// config returns a fresh client config for an upstream connection to host.
+// When the route changes the SNI, the chain is verified against the route's
+// verify name instead of the server name that was sent.
+func (p *tlsPolicy) config(host string, r Route) *tls.Config {
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12, RootCAs: p.roots}
+	var pinned *hostTLS
+	if h := p.lookup(host); h != nil {
+		if h.roots != nil {
+			cfg.RootCAs = h.roots
+		}
+		if h.cert != nil {
+			cfg.Certificates = []tls.Certificate{*h.cert}
+		}
+		if h.insecure {
+			cfg.InsecureSkipVerify = true
+			p.log.Debugf("upstream_tls: skipping certificate verification for %s", host)
+		}
+		if len(h.pins) > 0 {
+			pinned = h
+			if h.insecure {
+				cfg.VerifyConnection = h.verifyUnverifiedPins
+			} else {
+				cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+					return h.verifyPins(cs.VerifiedChains, cs.PeerCertificates)
+				}
+			}
+		}
+	}
+	sni, name := r.serverName(host), r.verifyName(host)
+	if sni == host && name == host {
+		return cfg
+	}
+	cfg.ServerName = sni
+	if !cfg.InsecureSkipVerify {
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			chains, err := verifyChain(cs, roots, name)
+			if err != nil {
+				return err
+			}
+			if pinned != nil {
+				return pinned.verifyPins(chains, cs.PeerCertificates)
+			}
+			return nil
+		}
+	}
+	return cfg
+}
+
+// verifyChain does the standard chain verification for name, used when the
+// server name sent differs from the name expected in the certificate.
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool, name string) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, &tls.CertificateVerificationError{Err: errors.New("no peer certificates")}
+	}
+	opts := x509.VerifyOptions{Roots: roots, DNSName: name, Intermediates: x509.NewCertPool()}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return nil, &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+	}
+	return chains, nil
+}
+
+// pinned reports whether crt has a pinned SPKI digest.
+func (h *hostTLS) pinned(crt *x509.Certificate) bool {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	for _, pin := range h.pins {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPins accepts the connection when a certificate of a verified chain
+// has a pinned SPKI digest. Certificates the server sent but that are not
+// part of a verified chain do not count.
+func (h *hostTLS) verifyPins(chains [][]*x509.Certificate, peer []*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, crt := range chain {
+			if h.pinned(crt) {
+				return nil
+			}
+		}
+	}
+	return &tls.CertificateVerificationError{UnverifiedCertificates: peer, Err: errPinMismatch}
+}
+
+// verifyUnverifiedPins stands in for chain verification when it is skipped:
+// the leaf itself must be pinned, or chain up to a pinned certificate the
+// server sent, whatever its names and validity.
+func (h *hostTLS) verifyUnverifiedPins(cs tls.ConnectionState) error {
+	peer := cs.PeerCertificates
+	if len(peer) == 0 {
+		return &tls.CertificateVerificationError{Err: errors.New("no peer certificates")}
+	}
+	if h.pinned(peer[0]) {
+		return nil
+	}
+	roots, inter := x509.NewCertPool(), x509.NewCertPool()
+	anchored := false
+	for _, crt := range peer[1:] {
+		if h.pinned(crt) {
+			roots.AddCert(crt)
+			anchored = true
+		} else {
+			inter.AddCert(crt)
+		}
+	}
+	if anchored {
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: inter,
+			CurrentTime:   peer[0].NotBefore,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		if _, err := peer[0].Verify(opts); err == nil {
+			return nil
+		}
+	}
+	return &tls.CertificateVerificationError{UnverifiedCertificates: peer, Err: errPinMismatch}
+}
+
+func basePool(noSystem bool) (*x509.CertPool, error) {
+	if noSystem {
+		return x509.NewCertPool(), nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("load system roots: %w", err)
+	}
+	return pool, nil
+}
+
+func appendCAFiles(pool *x509.CertPool, files []string) error {
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("read ca file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", f)
+		}
+	}
+	return nil
+}
+
+// parsePin decodes "sha256/<base64>" (the prefix is optional).
+func parsePin(pin string) ([]byte, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(d) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q", pin)
+	}
+	return d, nil
+}
+
+// verifyTTL bounds how long a verification failure is remembered.
+const verifyTTL = time.Minute
+
+type verifyResult struct {
+	err error
+	at  time.Time
+}
+
+// noteVerify remembers the verification failure of a TLS dial to the
+// requested hostport, or forgets it when err is nil. It is kept by host
+// alone, whichever rules scoped the route of the dial. Entries past
+// verifyTTL are dropped on insert.
+func (c *Client) noteVerify(hostport string, err error) {
+	now := time.Now()
+	c.verifyMu.Lock()
+	defer c.verifyMu.Unlock()
+	if err == nil {
+		delete(c.verified, hostport)
+		return
+	}
+	for k, v := range c.verified {
+		if now.Sub(v.at) >= verifyTTL {
+			delete(c.verified, k)
+		}
+	}
+	c.verified[hostport] = verifyResult{err: err, at: now}
+}
+
+// VerifyFailure returns the certificate verification error of the last TLS
+// dial to hostport, if it failed within a minute. It does not dial; network
+// and other handshake failures are not kept.
+func (c *Client) VerifyFailure(hostport string) error {
+	c.verifyMu.Lock()
+	defer c.verifyMu.Unlock()
+	if r, ok := c.verified[hostport]; ok && time.Since(r.at) < verifyTTL {
+		return r.err
+	}
+	return nil
+}
+
+// VerifyError extracts the certificate verification failure from a round
+// trip or dial error.
+func VerifyError(err error) (*tls.CertificateVerificationError, bool) {
+	var cve *tls.CertificateVerificationError
+	if errors.As(err, &cve) {
+		return cve, true
+	}
+	return nil, false
+}
@@ -0,0 +1,52 @@
+package egress
+
+import (
+	"context"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"terasu-proxy/internal/config"
+)
+
+func TestVerifyFailureByHost(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	c, err := New(&config.Config{DNS: config.DNS{Mode: "system"}}, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.VerifyFailure(u.Host); err != nil {
+		t.Fatalf("failure before any dial: %v", err)
+	}
+	// the route of a rule scoped by path or method, which the certificate
+	// served on CONNECT is not chosen with
+	ctx := WithRoute(context.Background(), Route{VerifyName: "scoped.test"})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := c.RoundTrip(req); !isVerifyError(err) {
+		t.Fatalf("round trip error = %v, want a verification failure", err)
+	}
+	if err := c.VerifyFailure(u.Host); !isVerifyError(err) {
+		t.Errorf("VerifyFailure = %v, want the failure of the scoped route", err)
+	}
+	if err := c.VerifyFailure("other.test:443"); err != nil {
+		t.Errorf("VerifyFailure of another host = %v", err)
+	}
+
+	c.noteVerify(u.Host, nil)
+	if err := c.VerifyFailure(u.Host); err != nil {
+		t.Errorf("VerifyFailure after a good dial = %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+// Package flow follows proxied requests and tunnels from acceptance to
+// completion and publishes each stage of their lifecycle to subscribers.
+package flow
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Stage string
+
+const (
+	Accepted Stage = "accepted" // a client connection, before any flow
+	Rule     Stage = "rule"     // rules matched for the flow
+	Request  Stage = "request"  // request headers received
+	Response Stage = "response" // response headers sent to the client
+	Progress Stage = "progress" // body bytes moved so far
+	Done     Stage = "done"
+	Error    Stage = "error"
+)
+
+const (
+	KindHTTP   = "http"
+	KindTunnel = "tunnel"
+	KindMITM   = "mitm" // a MITM session as a whole, not a request in it
+)
+
+// progressEvery spaces the progress events of a flow.
+const progressEvery = time.Second
+
+var seq atomic.Uint64
+
+// NewID returns a process-wide unique flow id. Flows, breakpoints and
+// captured exchanges share the id space.
+func NewID() uint64 { return seq.Add(1) }
+
+// State is the current view of a flow.
+type State struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"` // http | tunnel | mitm
+	Conn     string    `json:"conn,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	URL      string    `json:"url"`
+	Rules    []string  `json:"rules,omitempty"`
+	Stage    Stage     `json:"stage"`
+	Status   int       `json:"status,omitempty"`
+	BytesIn  int64     `json:"bytesIn"`  // sent to the client
+	BytesOut int64     `json:"bytesOut"` // received from the client
+	Started  time.Time `json:"started"`
+	Ms       int64     `json:"ms"`
+	Error    string    `json:"error,omitempty"`
+	ReplayOf uint64    `json:"replayOf,omitempty"`
+}
+
+// Event is one lifecycle stage. Flow is unset for accepted connections,
+// which are described by Conn and Client; Header is only set for the
+// request and response stages.
+type Event struct {
+	Type   Stage       `json:"type"`
+	Ts     time.Time   `json:"ts"`
+	Flow   *State      `json:"flow,omitempty"`
+	Header http.Header `json:"headers,omitempty"`
+	Conn   string      `json:"conn,omitempty"`
+	Client string      `json:"client,omitempty"`
+}
+
+// Bus keeps the flows in progress and broadcasts their events.
+type Bus struct {
+	mu   sync.Mutex
+	live map[uint64]*Flow
+
+	subMu sync.Mutex
+	subs  map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{live: make(map[uint64]*Flow), subs: make(map[chan Event]struct{})}
+}
+
+// Accepted publishes a new client connection.
+func (b *Bus) Accepted(conn, client string) {
+	b.publish(Event{Type: Accepted, Ts: time.Now().UTC(), Conn: conn, Client: client})
+}
+
+// Start registers a flow described by st; ID, Stage and Started are set here.
+func (b *Bus) Start(st State) *Flow {
+	st.ID = NewID()
+	st.Stage = Request
+	st.Started = time.Now().UTC()
+	f := &Flow{bus: b, st: st}
+	f.last.Store(st.Started.UnixNano())
+	b.mu.Lock()
+	b.live[st.ID] = f
+	b.mu.Unlock()
+	return f
+}
+
+// Live returns the flows in progress, oldest first.
+func (b *Bus) Live() []State {
+	b.mu.Lock()
+	out := make([]State, 0, len(b.live))
+	for _, f := range b.live {
+		out = append(out, f.State())
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Subscribe streams the events published from now on.
+func (b *Bus) Subscribe() (chan Event, func()) {
+	ch := make(chan Event, 256)
+	b.subMu.Lock()
+	b.subs[ch] = struct{}{}
+	b.subMu.Unlock()
+	return ch, func() {
+		b.subMu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.subMu.Unlock()
+	}
+}
+
+func (b *Bus) publish(ev Event) {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Flow is one request or tunnel. Its methods may be called from several
+// goroutines and are no-ops on a nil Flow.
+type Flow struct {
+	bus *Bus
+
+	mu       sync.Mutex
+	st       State
+	finished bool
+
+	in, out atomic.Int64
+	last    atomic.Int64 // unix nanos of the last progress event
+}
+
+func (f *Flow) ID() uint64 {
+	if f == nil {
+		return 0
+	}
+	return f.st.ID
+}
+
+// State returns a copy of the flow's current state.
+func (f *Flow) State() State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state()
+}
+
+func (f *Flow) state() State {
+	st := f.st
+	st.Rules = append([]string(nil), st.Rules...)
+	st.BytesIn, st.BytesOut = f.in.Load(), f.out.Load()
+	if !f.finished {
+		st.Ms = time.Since(st.Started).Milliseconds()
+	}
+	return st
+}
+
+// emit moves the flow to stage and publishes it, unless it has finished.
+func (f *Flow) emit(stage Stage, h http.Header, update func(*State)) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	if f.finished {
+		f.mu.Unlock()
+		return
+	}
+	if update != nil {
+		update(&f.st)
+	}
+	if stage != Progress {
+		f.st.Stage = stage
+	}
+	st := f.state()
+	f.mu.Unlock()
+	f.bus.publish(Event{Type: stage, Ts: time.Now().UTC(), Flow: &st, Header: h})
+}
+
+// Decide publishes the names of the rules matched for the flow.
+func (f *Flow) Decide(rules []string) {
+	f.emit(Rule, nil, func(st *State) { st.Rules = rules })
+}
+
+// Request publishes the request headers.
+func (f *Flow) Request(h http.Header) {
+	f.emit(Request, redact(h), nil)
+}
+
+// Response publishes the status and headers sent to the client.
+func (f *Flow) Response(status int, h http.Header) {
+	f.emit(Response, h.Clone(), func(st *State) { st.Status = status })
+}
+
+// AddIn counts bytes sent to the client.
+func (f *Flow) AddIn(n int64) {
+	if f == nil || n == 0 {
+		return
+	}
+	f.in.Add(n)
+	f.progress()
+}
+
+// AddOut counts bytes received from the client.
+func (f *Flow) AddOut(n int64) {
+	if f == nil || n == 0 {
+		return
+	}
+	f.out.Add(n)
+	f.progress()
+}
+
+// progress publishes the byte counts at most every progressEvery.
+func (f *Flow) progress() {
+	now := time.Now().UnixNano()
+	last := f.last.Load()
+	if now-last < int64(progressEvery) || !f.last.CompareAndSwap(last, now) {
+		return
+	}
+	f.emit(Progress, nil, nil)
+}
+
+// Fail records the error that ends the flow; the first one is kept.
+func (f *Flow) Fail(err string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	if f.st.Error == "" {
+		f.st.Error = err
+	}
+	f.mu.Unlock()
+}
+
+// Finish publishes the flow's completion, or its error, once.
+func (f *Flow) Finish() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	if f.finished {
+		f.mu.Unlock()
+		return
+	}
+	f.st.Ms = time.Since(f.st.Started).Milliseconds()
+	f.st.Stage = Done
+	if f.st.Error != "" {
+		f.st.Stage = Error
+	}
+	st := f.state()
+	f.finished = true
+	f.mu.Unlock()
+
+	f.bus.mu.Lock()
+	delete(f.bus.live, st.ID)
+	f.bus.mu.Unlock()
+	f.bus.publish(Event{Type: st.Stage, Ts: time.Now().UTC(), Flow: &st})
+}
+
+// redact drops credentials meant for the proxy itself.
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	h.Del("Proxy-Authorization")
+	return h
+}
+
+type flowKey struct{}
+
+// With attaches f to ctx.
+func With(ctx context.Context, f *Flow) context.Context {
+	return context.WithValue(ctx, flowKey{}, f)
+}
+
+// From returns the flow of ctx, or nil.
+func From(ctx context.Context) *Flow {
+	f, _ := ctx.Value(flowKey{}).(*Flow)
+	return f
+}
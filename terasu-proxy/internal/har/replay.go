@@ -0,0 +1,76 @@
+package har
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Replayer finds recorded entries for requests. Entries recorded more than
+// once for the same request are returned in turn, the last one repeating.
+type Replayer struct {
+	mu      sync.Mutex
+	entries map[string][]*Entry
+	next    map[string]int
+	n       int
+}
+
+func NewReplayer(hs ...*HAR) *Replayer {
+	p := &Replayer{entries: make(map[string][]*Entry), next: make(map[string]int)}
+	for _, h := range hs {
+		for i := range h.Log.Entries {
+			e := &h.Log.Entries[i]
+			u, err := url.Parse(e.Request.URL)
+			if err != nil {
+				continue
+			}
+			p.n++
+			exact, loose := keys(e.Request.Method, u)
+			p.entries[exact] = append(p.entries[exact], e)
+			if loose != exact {
+				p.entries[loose] = append(p.entries[loose], e)
+			}
+		}
+	}
+	return p
+}
+
+// Len returns the number of replayable entries.
+func (p *Replayer) Len() int { return p.n }
+
+// Find returns the entry for a request, matching method, host, path and
+// query, then ignoring the query. It returns nil when nothing matches.
+func (p *Replayer) Find(method string, u *url.URL) *Entry {
+	exact, loose := keys(method, u)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range []string{exact, loose} {
+		if es := p.entries[k]; len(es) > 0 {
+			i := p.next[k]
+			if i < len(es)-1 {
+				p.next[k] = i + 1
+			}
+			return es[i]
+		}
+	}
+	return nil
+}
+
+// keys ignores the scheme and default ports so that recordings made through
+// plain and intercepted connections match alike.
+func keys(method string, u *url.URL) (exact, loose string) {
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	loose = strings.ToUpper(method) + " " + host + path
+	exact = loose
+	if u.RawQuery != "" {
+		exact += "?" + u.RawQuery
+	}
+	return exact, loose
+}
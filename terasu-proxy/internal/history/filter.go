@@ -0,0 +1,136 @@
+package history
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"terasu-proxy/internal/metrics"
+	"terasu-proxy/internal/rules"
+)
+
+// Filter selects events. From is inclusive and To exclusive; zero times
+// leave the range open.
+type Filter struct {
+	From, To time.Time
+	Host     string // domain suffix, as for /capture.har
+	// Code is an exact status code, or a class such as 5 for 5xx; -1 is any.
+	Code  int
+	Class bool
+}
+
+// ParseFilter reads from, to, host and code query parameters. Times are
+// RFC 3339, unix seconds or a duration back from now; code is a status such
+// as 404, a class such as 5xx, or 0 for failed round trips.
+func ParseFilter(q url.Values) (Filter, error) {
+	f := Filter{Host: strings.ToLower(q.Get("host")), Code: -1}
+	var err error
+	if f.From, err = parseTime(q.Get("from")); err != nil {
+		return f, errors.New("bad from")
+	}
+	if f.To, err = parseTime(q.Get("to")); err != nil {
+		return f, errors.New("bad to")
+	}
+	if v := strings.ToLower(q.Get("code")); v != "" {
+		if c, ok := strings.CutSuffix(v, "xx"); ok && len(c) == 1 {
+			v, f.Class = c, true
+		}
+		if f.Code, err = strconv.Atoi(v); err != nil || f.Code < 0 {
+			return f, errors.New("bad code")
+		}
+	}
+	return f, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// Match reports whether ev is selected.
+func (f Filter) Match(ev metrics.RequestEvent) bool {
+	if !f.From.IsZero() && ev.Ts.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !ev.Ts.Before(f.To) {
+		return false
+	}
+	if f.Host != "" && !rules.HostMatches(ev.Host, []string{f.Host}) {
+		return false
+	}
+	switch {
+	case f.Code < 0:
+	case f.Class:
+		return ev.Code/100 == f.Code
+	default:
+		return ev.Code == f.Code
+	}
+	return true
+}
+
+// Cursor is where a query resumes. In the log it is a segment and the
+// index of an event in it; among the events kept in memory it is the time
+// of the next event.
+type Cursor struct {
+	seg int64
+	off int64
+}
+
+// IsZero reports the cursor of the first page.
+func (c Cursor) IsZero() bool { return c == Cursor{} }
+
+// String encodes the cursor for the next query parameter.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.seg, c.off)))
+}
+
+// ParseCursor decodes a cursor; the empty string is the first page.
+func ParseCursor(v string) (Cursor, error) {
+	var c Cursor
+	if v == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return c, errors.New("bad cursor")
+	}
+	seg, off, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return c, errors.New("bad cursor")
+	}
+	if c.seg, err = strconv.ParseInt(seg, 10, 64); err != nil || c.seg < 0 {
+		return Cursor{}, errors.New("bad cursor")
+	}
+	if c.off, err = strconv.ParseInt(off, 10, 64); err != nil || c.off < 0 {
+		return Cursor{}, errors.New("bad cursor")
+	}
+	return c, nil
+}
+
+// Select returns up to limit events of evs matching f, starting at after,
+// and the cursor of the first one left out, if any.
+func Select(evs []metrics.RequestEvent, f Filter, limit int, after Cursor) ([]metrics.RequestEvent, Cursor) {
+	var out []metrics.RequestEvent
+	for _, ev := range evs {
+		if ev.Ts.UnixNano() < after.off || !f.Match(ev) {
+			continue
+		}
+		if len(out) == limit {
+			return out, Cursor{off: ev.Ts.UnixNano()}
+		}
+		out = append(out, ev)
+	}
+	return out, Cursor{}
+}
@@ -0,0 +1,458 @@
+// Package history keeps the request event log and snapshots of the metrics
+// totals on disk, so that both survive restarts.
+//
+// Events are appended as gob records to segment files named after the time
+// they were opened; a segment is never reopened, since a gob stream cannot
+// be continued by a new encoder. Whole segments are dropped by age and by
+// the total size of the log.
+package history
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/metrics"
+)
+
+const (
+	totalsFile  = "totals.gob"
+	segPrefix   = "events-"
+	segSuffix   = ".gob"
+	flushEvery  = time.Second
+	minSegBytes = 1 << 20
+	// queued bounds the events waiting to be written; more are dropped.
+	queued = 4096
+	// restored is the number of recent events loaded back for /logs.
+	restored = 200
+	// segSkew is how much earlier than its segment an event may be timed,
+	// having waited in the queue.
+	segSkew = time.Minute
+)
+
+// Store appends events to the log and saves the totals of an aggregator.
+type Store struct {
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+	segBytes int64
+	segAge   time.Duration
+	agg      *metrics.Aggregator
+	log      *logrus.Logger
+
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	enc      *gob.Encoder
+	size     int64
+	opened   time.Time
+	failing  bool
+	closed   bool
+	stop     chan struct{}
+	stopped  chan struct{}
+	interval time.Duration
+
+	events   chan metrics.RequestEvent
+	dropped  atomic.Uint64
+	reported uint64 // dropped count last logged, owned by loop
+}
+
+// Open loads the totals and recent events saved in cfg.Dir into agg, then
+// records agg's events from now on. It returns nil when history is off.
+func Open(cfg config.History, agg *metrics.Aggregator, log *logrus.Logger) (*Store, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:      cfg.Dir,
+		maxAge:   cfg.MaxAge,
+		maxBytes: cfg.MaxBytes,
+		segBytes: cfg.MaxBytes / 16,
+		segAge:   cfg.MaxAge / 16,
+		agg:      agg,
+		log:      log,
+		interval: cfg.Interval,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		events:   make(chan metrics.RequestEvent, queued),
+	}
+	if s.segBytes < minSegBytes {
+		s.segBytes = minSegBytes
+	}
+	if s.segAge <= 0 {
+		s.segAge = 24 * time.Hour
+	}
+	if s.interval <= 0 {
+		s.interval = time.Minute
+	}
+	t, err := s.loadTotals()
+	if err != nil {
+		log.Warnf("history: totals not restored: %v", err)
+	}
+	recent := s.tail(restored)
+	agg.Restore(t, recent)
+	log.Infof("history: dir=%s restored %d requests since %s and %d recent events", cfg.Dir, t.Requests, t.Since.Format(time.RFC3339), len(recent))
+	s.prune()
+	agg.Record(s.enqueue)
+	go s.loop()
+	return s, nil
+}
+
+// Close flushes the log and saves the totals.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.stopped
+	s.mu.Lock()
+	s.closeSegment()
+	s.mu.Unlock()
+	return s.saveTotals()
+}
+
+// Dropped returns the number of events left out of the log because it
+// could not keep up.
+func (s *Store) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+// enqueue hands ev to loop without blocking the request that produced it.
+func (s *Store) enqueue(ev metrics.RequestEvent) {
+	if ev.Ts.IsZero() {
+		ev.Ts = time.Now().UTC()
+	}
+	select {
+	case s.events <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Store) loop() {
+	defer close(s.stopped)
+	flush := time.NewTicker(flushEvery)
+	defer flush.Stop()
+	save := time.NewTicker(s.interval)
+	defer save.Stop()
+	for {
+		select {
+		case ev := <-s.events:
+			s.append(ev)
+		case <-flush.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		case <-save.C:
+			if err := s.saveTotals(); err != nil {
+				s.log.Warnf("history: save totals: %v", err)
+			}
+			s.prune()
+			if n := s.dropped.Load(); n != s.reported {
+				s.log.Warnf("history: %d events dropped, the log could not keep up", n-s.reported)
+				s.reported = n
+			}
+		case <-s.stop:
+			for {
+				select {
+				case ev := <-s.events:
+					s.append(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// append writes ev to the current segment, opening a new one when it is
+// full or old.
+func (s *Store) append(ev metrics.RequestEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enc != nil && (s.size >= s.segBytes || time.Since(s.opened) >= s.segAge) {
+		s.closeSegment()
+	}
+	if s.enc == nil {
+		if err := s.openSegment(); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	if err := s.enc.Encode(&ev); err != nil {
+		s.fail(err)
+		s.closeSegment()
+		return
+	}
+	s.failing = false
+}
+
+// fail logs the first of a run of write errors.
+func (s *Store) fail(err error) {
+	if !s.failing {
+		s.log.Warnf("history: event log: %v", err)
+		s.failing = true
+	}
+}
+
+func (s *Store) openSegment() error {
+	now := time.Now()
+	f, err := os.OpenFile(filepath.Join(s.dir, segName(now)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f, s.opened, s.size = f, now, 0
+	s.w = bufio.NewWriter(f)
+	s.enc = gob.NewEncoder(&countingWriter{w: s.w, n: &s.size})
+	return nil
+}
+
+func (s *Store) closeSegment() {
+	if s.f == nil {
+		return
+	}
+	s.flush()
+	_ = s.f.Close()
+	s.f, s.w, s.enc = nil, nil, nil
+}
+
+func (s *Store) flush() {
+	if s.w != nil {
+		if err := s.w.Flush(); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func (s *Store) loadTotals() (metrics.Totals, error) {
+	var t metrics.Totals
+	f, err := os.Open(filepath.Join(s.dir, totalsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&t); err != nil {
+		return metrics.Totals{}, err
+	}
+	return t, nil
+}
+
+// saveTotals replaces the totals file, so that a crash leaves the old one.
+func (s *Store) saveTotals() error {
+	tmp := filepath.Join(s.dir, totalsFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	t := s.agg.Totals()
+	if err := gob.NewEncoder(f).Encode(&t); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, totalsFile))
+}
+
+// segment is a log file opened at start; events in it are no newer than
+// its modification time, but may predate start.
+type segment struct {
+	path  string
+	start time.Time
+	end   time.Time
+	size  int64
+}
+
+func segName(t time.Time) string {
+	return fmt.Sprintf("%s%020d%s", segPrefix, t.UnixNano(), segSuffix)
+}
+
+// segments lists the log files, oldest first.
+func (s *Store) segments() []segment {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	var out []segment
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, segPrefix) || !strings.HasSuffix(name, segSuffix) {
+			continue
+		}
+		ns, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segPrefix), segSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, segment{path: filepath.Join(s.dir, name), start: time.Unix(0, ns), end: info.ModTime(), size: info.Size()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start.Before(out[j].start) })
+	return out
+}
+
+// prune drops the segments past the age limit, then the oldest ones until
+// the log fits the size limit. The segment being written is kept.
+func (s *Store) prune() {
+	s.mu.Lock()
+	// an idle segment is closed so that it can age out
+	if s.f != nil && time.Since(s.opened) >= s.segAge {
+		s.closeSegment()
+	}
+	var current string
+	if s.f != nil {
+		current = s.f.Name()
+	}
+	s.mu.Unlock()
+	segs := s.segments()
+	var total int64
+	for _, sg := range segs {
+		total += sg.size
+	}
+	cutoff := time.Now().Add(-s.maxAge)
+	for _, sg := range segs {
+		if sg.path == current {
+			break
+		}
+		if !(s.maxAge > 0 && sg.end.Before(cutoff)) && !(s.maxBytes > 0 && total > s.maxBytes) {
+			break
+		}
+		if err := os.Remove(sg.path); err != nil {
+			s.log.Warnf("history: %v", err)
+			break
+		}
+		total -= sg.size
+	}
+}
+
+// readSegment decodes the events of a segment until fn returns false. A
+// record cut short by a crash ends the segment.
+func readSegment(path string, fn func(metrics.RequestEvent) bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var ev metrics.RequestEvent
+		if err := dec.Decode(&ev); err != nil {
+			return
+		}
+		if !fn(ev) {
+			return
+		}
+	}
+}
+
+// tail returns up to n of the last events logged, oldest first.
+func (s *Store) tail(n int) []metrics.RequestEvent {
+	segs := s.segments()
+	var out []metrics.RequestEvent
+	for i := len(segs) - 1; i >= 0 && len(out) < n; i-- {
+		var evs []metrics.RequestEvent
+		readSegment(segs[i].path, func(ev metrics.RequestEvent) bool {
+			evs = append(evs, ev)
+			return true
+		})
+		out = append(evs, out...)
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// Query returns up to limit logged events matching f, oldest first,
+// starting at after, and the cursor of the first event left out, if any.
+// Events are kept in the order they were logged, which may differ slightly
+// from the order of their times, so segments are only skipped by their
+// last write, and the query ends at the first segment opened well after
+// f.To.
+func (s *Store) Query(f Filter, limit int, after Cursor) ([]metrics.RequestEvent, Cursor) {
+	s.mu.Lock()
+	s.flush()
+	s.mu.Unlock()
+	var out []metrics.RequestEvent
+	var next Cursor
+	for _, sg := range s.segments() {
+		seg := sg.start.UnixNano()
+		if seg < after.seg {
+			continue
+		}
+		if !f.From.IsZero() && sg.end.Before(f.From) {
+			continue
+		}
+		if !f.To.IsZero() && sg.start.After(f.To.Add(segSkew)) {
+			break
+		}
+		var skip, i int64
+		if seg == after.seg {
+			skip = after.off
+		}
+		readSegment(sg.path, func(ev metrics.RequestEvent) bool {
+			n := i
+			i++
+			if n < skip || !f.Match(ev) {
+				return true
+			}
+			if len(out) == limit {
+				next = Cursor{seg: seg, off: n}
+				return false
+			}
+			out = append(out, ev)
+			return true
+		})
+		if !next.IsZero() {
+			break
+		}
+	}
+	return out, next
+}
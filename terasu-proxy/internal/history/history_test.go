@@ -0,0 +1,100 @@
+package history
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"terasu-proxy/internal/metrics"
+)
+
+// writeSegment writes a segment opened at start with an event per path,
+// a second apart from start.
+func writeSegment(t *testing.T, dir string, start time.Time, paths ...string) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, segName(start)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := gob.NewEncoder(f)
+	for i, p := range paths {
+		ev := metrics.RequestEvent{Ts: start.Add(time.Duration(i) * time.Second), Host: "a.test", Path: p, Code: 200}
+		if err := enc.Encode(&ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func paths(evs []metrics.RequestEvent) []string {
+	var out []string
+	for _, ev := range evs {
+		out = append(out, ev.Path)
+	}
+	return out
+}
+
+func TestQueryPages(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSegment(t, dir, t0, "/1", "/2", "/3")
+	writeSegment(t, dir, t0.Add(time.Hour), "/4", "/5")
+	writeSegment(t, dir, t0.Add(2*time.Hour), "/6")
+	s := &Store{dir: dir}
+
+	tests := []struct {
+		name  string
+		f     Filter
+		limit int
+		want  [][]string
+	}{
+		{"whole pages", Filter{Code: -1}, 2, [][]string{{"/1", "/2"}, {"/3", "/4"}, {"/5", "/6"}}},
+		{"page per segment", Filter{Code: -1}, 3, [][]string{{"/1", "/2", "/3"}, {"/4", "/5", "/6"}}},
+		{"to ends early", Filter{Code: -1, To: t0.Add(time.Hour + 90*time.Second)}, 4, [][]string{{"/1", "/2", "/3", "/4"}, {"/5"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]string
+			var after Cursor
+			for i := 0; i < 10; i++ {
+				evs, next := s.Query(tt.f, tt.limit, after)
+				got = append(got, paths(evs))
+				if next.IsZero() {
+					break
+				}
+				if c, err := ParseCursor(next.String()); err != nil || c != next {
+					t.Fatalf("cursor %v does not round trip: %v, %v", next, c, err)
+				}
+				after = next
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryStopsAfterTo(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSegment(t, dir, t0, "/1")
+	// events in a segment opened well after To are not read, even when
+	// their times would match
+	f, err := os.Create(filepath.Join(dir, segName(t0.Add(time.Hour))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := metrics.RequestEvent{Ts: t0.Add(time.Second), Host: "a.test", Path: "/late", Code: 200}
+	if err := gob.NewEncoder(f).Encode(&ev); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	s := &Store{dir: dir}
+	evs, next := s.Query(Filter{Code: -1, To: t0.Add(time.Minute)}, 10, Cursor{})
+	if got := paths(evs); !reflect.DeepEqual(got, []string{"/1"}) || !next.IsZero() {
+		t.Errorf("Query = %v, %v, want [/1] and no cursor", got, next)
+	}
+}
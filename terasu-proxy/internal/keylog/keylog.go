@@ -0,0 +1,107 @@
+// Package keylog writes TLS secrets in the NSS key log format read by
+// Wireshark, to a file and to subscribers of the admin stream.
+package keylog
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	subs map[chan []byte]struct{}
+}
+
+// Open appends to path; an empty path only serves subscribers.
+func Open(path string) (*Log, error) {
+	l := &Log{subs: make(map[chan []byte]struct{})}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		l.f = f
+	}
+	return l, nil
+}
+
+// For returns the KeyLogWriter of one TLS connection. Its first secret is
+// preceded by a comment line naming the connection.
+func (l *Log) For(conn, side, host string) io.Writer {
+	return &connWriter{l: l, tag: "# conn=" + conn + " " + side + " " + host + "\n"}
+}
+
+type connWriter struct {
+	l    *Log
+	tag  string
+	once sync.Once
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { w.l.write([]byte(w.tag)) })
+	w.l.write(p)
+	return len(p), nil
+}
+
+func (l *Log) write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		_, _ = l.f.Write(p)
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- append([]byte(nil), p...):
+		default:
+		}
+	}
+}
+
+// Subscribe streams the lines written from now on.
+func (l *Log) Subscribe() (chan []byte, func()) {
+	ch := make(chan []byte, 256)
+	l.mu.Lock()
+	l.subs[ch] = struct{}{}
+	l.mu.Unlock()
+	return ch, func() {
+		l.mu.Lock()
+		if _, ok := l.subs[ch]; ok {
+			delete(l.subs, ch)
+			close(ch)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *Log) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+type connKey struct{}
+
+type connLog struct {
+	l    *Log
+	conn string
+}
+
+// WithConn enables key logging for upstream handshakes made for ctx, tagged
+// with the client connection id.
+func WithConn(ctx context.Context, l *Log, conn string) context.Context {
+	return context.WithValue(ctx, connKey{}, connLog{l: l, conn: conn})
+}
+
+// Writer returns the KeyLogWriter for a handshake made for ctx, or nil when
+// key logging is not enabled for it.
+func Writer(ctx context.Context, side, host string) io.Writer {
+	c, ok := ctx.Value(connKey{}).(connLog)
+	if !ok {
+		return nil
+	}
+	return c.l.For(c.conn, side, host)
+}
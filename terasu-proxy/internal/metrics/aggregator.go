@@ -15,50 +15,134 @@ type RequestEvent struct {
 	Ms       int64     `json:"ms"`
 	BytesIn  int64     `json:"bytesIn"`
 	BytesOut int64     `json:"bytesOut"`
+	// VerifyError is the upstream certificate verification failure, if any.
+	VerifyError string `json:"verifyError,omitempty"`
+	// ErrorClass and Error describe a failed upstream round trip or tunnel
+	// dial, whose Code is 0: dns, refused, connect, reset, timeout, tls,
+	// fragment, verify, circuit, canceled or other.
+	ErrorClass string `json:"errorClass,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Upstream describes rule overrides of the upstream address, SNI or Host.
+	Upstream string `json:"upstream,omitempty"`
+	// Retries is the number of upstream attempts made after the first.
+	Retries int `json:"retries,omitempty"`
+	// Fault lists the faults injected by rules, e.g. "latency=120ms abort".
+	Fault string `json:"fault,omitempty"`
+	// Conn identifies the client connection, as in TLS key log comments.
+	Conn string `json:"conn,omitempty"`
+	// Flow is the id of the flow in lifecycle events, breakpoints and captures.
+	Flow uint64 `json:"flow,omitempty"`
+	// Timing breaks an upstream request down by phase.
+	Timing *Timing `json:"timing,omitempty"`
+	// Progress marks the running totals of a tunnel that is still open.
+	Progress bool `json:"progress,omitempty"`
 }
 
 type hostStat struct {
 	Req      uint64 `json:"req"`
 	BytesIn  uint64 `json:"bytesIn"`
 	BytesOut uint64 `json:"bytesOut"`
+	// Errors counts failed requests by error class.
+	Errors map[string]uint64 `json:"errors,omitempty"`
+	// Latency is the request duration histogram of the host.
+	Latency *HistogramStat `json:"latency,omitempty"`
+}
+
+// BreakerStat is the circuit breaker state of an upstream host.
+type BreakerStat struct {
+	State     string    `json:"state"` // closed | open | half-open
+	Failures  int       `json:"failures"`
+	OpenUntil time.Time `json:"openUntil"`
 }
 
 type Snapshot struct {
-	UptimeSec     uint64              `json:"uptimeSec"`
+	UptimeSec uint64 `json:"uptimeSec"`
+	// Since is when counting began, before restarts when history is kept.
+	Since         time.Time           `json:"since"`
 	TotalRequests uint64              `json:"totalRequests"`
 	Codes         map[int]uint64      `json:"codes"`
 	BytesIn       uint64              `json:"bytesIn"`
 	BytesOut      uint64              `json:"bytesOut"`
 	Hosts         map[string]hostStat `json:"hosts"`
+	Errors        map[string]uint64   `json:"errors,omitempty"`
+	// Latency is the request duration histogram over all hosts; tunnels,
+	// whose duration is their lifetime, are left out.
+	Latency HistogramStat `json:"latency"`
+	// Timings holds per-host histograms of the request phases, bucketed by
+	// Buckets.
+	Timings  map[string]map[string]HistogramStat `json:"timings,omitempty"`
+	Buckets  []float64                           `json:"buckets,omitempty"`
+	Breakers map[string]BreakerStat              `json:"breakers,omitempty"`
+	Pools    map[string]PoolStat                 `json:"pools,omitempty"`
+	// Active counts open CONNECT tunnels ("tunnel") and MITM sessions ("mitm").
+	Active map[string]int64 `json:"active"`
 }
 
+// recentEvents is the number of events replayed to new subscribers.
+const recentEvents = 200
+
 type Aggregator struct {
 	startedAt     time.Time
+	since         time.Time // first start, restored from history
 	totalRequests atomic.Uint64
 	bytesIn       atomic.Uint64
 	bytesOut      atomic.Uint64
 
-	mu    sync.Mutex
-	codes map[int]uint64
-	hosts map[string]hostStat
-	buf   []RequestEvent // ring buffer for recent events to support late subscribers
+	mu      sync.Mutex
+	codes   map[int]uint64
+	hosts   map[string]hostStat
+	errors  map[string]uint64
+	timings map[string]map[string]*Histogram // host -> phase
+
+	latency     *Histogram
+	hostLatency hostHistograms
+	breakers    map[string]BreakerStat
+	buf         []RequestEvent // ring buffer for recent events to support late subscribers
+	tunnels     map[*Tunnel]struct{}
+	mitm        int64
+
+	poolMu sync.Mutex
+	pools  map[string]*PoolGauge
+
+	series *series
 
 	// subscribers receive events; non-blocking broadcast
 	subMu sync.Mutex
 	subs  map[chan RequestEvent]struct{}
+
+	record func(RequestEvent)
 }
 
 func NewAggregator() *Aggregator {
+	now := time.Now()
 	return &Aggregator{
-		startedAt: time.Now(),
+		startedAt: now,
+		since:     now.UTC(),
 		codes:     make(map[int]uint64),
 		hosts:     make(map[string]hostStat),
-		buf:       make([]RequestEvent, 0, 200),
+		errors:    make(map[string]uint64),
+		timings:   make(map[string]map[string]*Histogram),
+		latency:   newHistogram(),
+		breakers:  make(map[string]BreakerStat),
+		pools:     make(map[string]*PoolGauge),
+		series:    newSeries(),
+		tunnels:   make(map[*Tunnel]struct{}),
+		buf:       make([]RequestEvent, 0, recentEvents),
 		subs:      make(map[chan RequestEvent]struct{}),
 	}
 }
 
 func (a *Aggregator) Add(ev RequestEvent) {
+	a.mu.Lock()
+	phases, record := a.add(ev)
+	a.mu.Unlock()
+	a.added(ev, phases, record)
+}
+
+// add counts ev under a.mu, so that snapshots see its bytes together with
+// whatever the caller changes in the same critical section. It returns the
+// work left for added, which runs unlocked.
+func (a *Aggregator) add(ev RequestEvent) (map[string]*Histogram, func(RequestEvent)) {
 	a.totalRequests.Add(1)
 	if ev.BytesIn > 0 {
 		a.bytesIn.Add(uint64(ev.BytesIn))
@@ -66,7 +150,6 @@ func (a *Aggregator) Add(ev RequestEvent) {
 	if ev.BytesOut > 0 {
 		a.bytesOut.Add(uint64(ev.BytesOut))
 	}
-	a.mu.Lock()
 	a.codes[ev.Code] = a.codes[ev.Code] + 1
 	hs := a.hosts[ev.Host]
 	hs.Req++
@@ -76,15 +159,57 @@ func (a *Aggregator) Add(ev RequestEvent) {
 	if ev.BytesOut > 0 {
 		hs.BytesOut += uint64(ev.BytesOut)
 	}
+	if ev.ErrorClass != "" {
+		a.errors[ev.ErrorClass]++
+		if hs.Errors == nil {
+			hs.Errors = make(map[string]uint64)
+		}
+		hs.Errors[ev.ErrorClass]++
+	}
 	a.hosts[ev.Host] = hs
+	var phases map[string]*Histogram
+	if ev.Timing != nil {
+		th := ev.Host
+		if _, ok := a.timings[th]; !ok && len(a.timings) >= maxHistogramHosts {
+			th = otherHosts
+		}
+		if phases = a.timings[th]; phases == nil {
+			phases = make(map[string]*Histogram, len(Phases))
+			for _, p := range Phases {
+				phases[p] = newHistogram()
+			}
+			a.timings[th] = phases
+		}
+	}
 	// append to ring buffer (keep last 200 events)
 	if len(a.buf) == cap(a.buf) {
 		// drop oldest by shifting slice start by 1
 		a.buf = a.buf[1:]
 	}
 	a.buf = append(a.buf, ev)
-	a.mu.Unlock()
+	return phases, a.record
+}
+
+// added observes the histograms and series of ev and hands it on.
+func (a *Aggregator) added(ev RequestEvent, phases map[string]*Histogram, record func(RequestEvent)) {
+	if ev.Method != "CONNECT" {
+		a.latency.Observe(float64(ev.Ms))
+		a.hostLatency.get(ev.Host).Observe(float64(ev.Ms))
+	}
+	if record != nil {
+		record(ev)
+	}
+	for p, h := range phases {
+		if v, ok := ev.Timing.phase(p); ok {
+			h.Observe(v)
+		}
+	}
+	a.series.add(ev, time.Now())
+	a.publish(ev)
+}
 
+// publish broadcasts ev to subscribers without blocking.
+func (a *Aggregator) publish(ev RequestEvent) {
 	a.subMu.Lock()
 	for ch := range a.subs {
 		select {
@@ -97,24 +222,93 @@ func (a *Aggregator) Add(ev RequestEvent) {
 
 func (a *Aggregator) Snapshot() Snapshot {
 	s := Snapshot{
-		UptimeSec:     uint64(time.Since(a.startedAt).Seconds()),
-		TotalRequests: a.totalRequests.Load(),
-		BytesIn:       a.bytesIn.Load(),
-		BytesOut:      a.bytesOut.Load(),
-		Codes:         make(map[int]uint64),
-		Hosts:         make(map[string]hostStat),
+		UptimeSec: uint64(time.Since(a.startedAt).Seconds()),
+		Since:     a.since,
+		Codes:     make(map[int]uint64),
+		Hosts:     make(map[string]hostStat),
 	}
 	a.mu.Lock()
+	// read with the open tunnels, which move their bytes here on close
+	s.TotalRequests = a.totalRequests.Load()
+	s.BytesIn, s.BytesOut = a.bytesIn.Load(), a.bytesOut.Load()
 	for k, v := range a.codes {
 		s.Codes[k] = v
 	}
 	for k, v := range a.hosts {
+		if v.Errors != nil {
+			errs := make(map[string]uint64, len(v.Errors))
+			for c, n := range v.Errors {
+				errs[c] = n
+			}
+			v.Errors = errs
+		}
 		s.Hosts[k] = v
 	}
+	s.Latency = a.latency.stat()
+	s.Buckets = Buckets
+	for host, st := range a.hostLatency.stats() {
+		st := st
+		hs := s.Hosts[host]
+		hs.Latency = &st
+		s.Hosts[host] = hs
+	}
+	if len(a.timings) > 0 {
+		s.Timings = make(map[string]map[string]HistogramStat, len(a.timings))
+		for host, phases := range a.timings {
+			m := make(map[string]HistogramStat, len(phases))
+			for p, h := range phases {
+				m[p] = h.stat()
+			}
+			s.Timings[host] = m
+		}
+	}
+	if len(a.errors) > 0 {
+		s.Errors = make(map[string]uint64, len(a.errors))
+		for k, v := range a.errors {
+			s.Errors[k] = v
+		}
+	}
+	// bytes of open tunnels count before their events are added
+	for t := range a.tunnels {
+		in, out := uint64(t.in.Load()), uint64(t.out.Load())
+		s.BytesIn += in
+		s.BytesOut += out
+		hs := s.Hosts[t.host]
+		hs.BytesIn += in
+		hs.BytesOut += out
+		s.Hosts[t.host] = hs
+	}
+	s.Active = map[string]int64{"tunnel": int64(len(a.tunnels)), "mitm": a.mitm}
+	if len(a.breakers) > 0 {
+		s.Breakers = make(map[string]BreakerStat, len(a.breakers))
+		for k, v := range a.breakers {
+			s.Breakers[k] = v
+		}
+	}
 	a.mu.Unlock()
+	s.Pools = a.poolStats()
 	return s
 }
 
+// MITMSession counts an opened (delta 1) or closed (delta -1) MITM session.
+func (a *Aggregator) MITMSession(delta int64) {
+	a.mu.Lock()
+	a.mitm += delta
+	a.mu.Unlock()
+}
+
+// SetBreaker publishes the circuit breaker state of host; a "closed" state
+// removes the host from the snapshot.
+func (a *Aggregator) SetBreaker(host string, st BreakerStat) {
+	a.mu.Lock()
+	if st.State == "closed" {
+		delete(a.breakers, host)
+	} else {
+		a.breakers[host] = st
+	}
+	a.mu.Unlock()
+}
+
 func (a *Aggregator) Subscribe() (chan RequestEvent, func()) {
 	ch := make(chan RequestEvent, 64)
 	// take a snapshot of recent events for replay
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+)
+
+// annotations collects event changes made by other layers for one request.
+type annotations struct {
+	mu  sync.Mutex
+	fns []func(*RequestEvent)
+}
+
+type annotationsKey struct{}
+
+// WithAnnotations prepares ctx so that Annotate calls made while handling the
+// request are applied to the RequestEvent recorded for it. Transport adds it
+// on its own when missing; call it earlier to annotate from outer layers.
+func WithAnnotations(ctx context.Context) context.Context {
+	if ctx.Value(annotationsKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, annotationsKey{}, &annotations{})
+}
+
+// Annotate records a change to the request's event. It is a no-op when ctx
+// was not prepared by WithAnnotations.
+func Annotate(ctx context.Context, fn func(*RequestEvent)) {
+	a, _ := ctx.Value(annotationsKey{}).(*annotations)
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.fns = append(a.fns, fn)
+	a.mu.Unlock()
+}
+
+// Apply runs the changes recorded in ctx on ev, for events recorded outside
+// Transport.
+func Apply(ctx context.Context, ev *RequestEvent) { applyAnnotations(ctx, ev) }
+
+// applyAnnotations runs the recorded changes on ev in order.
+func applyAnnotations(ctx context.Context, ev *RequestEvent) {
+	a, _ := ctx.Value(annotationsKey{}).(*annotations)
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, fn := range a.fns {
+		fn(ev)
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Buckets are the upper bounds in milliseconds of histogram buckets; one
+// more bucket counts larger values.
+var Buckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// Histogram counts durations in fixed buckets without locking.
+type Histogram struct {
+	counts []atomic.Uint64
+	sumUs  atomic.Uint64
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]atomic.Uint64, len(Buckets)+1)}
+}
+
+// Observe records a duration in milliseconds.
+func (h *Histogram) Observe(ms float64) {
+	h.counts[bucketOf(ms)].Add(1)
+	h.sumUs.Add(uint64(math.Max(ms, 0) * 1000))
+}
+
+// bucketOf returns the index of the bucket counting ms.
+func bucketOf(ms float64) int {
+	for i, b := range Buckets {
+		if ms <= b {
+			return i
+		}
+	}
+	return len(Buckets)
+}
+
+// HistogramStat is a histogram in a snapshot. Counts has one entry per
+// bucket in Snapshot.Buckets plus the last, unbounded one. Percentiles are
+// interpolated within buckets; beyond the last bound they report that bound.
+type HistogramStat struct {
+	Counts []uint64 `json:"counts"`
+	Count  uint64   `json:"count"`
+	SumMs  float64  `json:"sumMs"`
+	P50    float64  `json:"p50"`
+	P90    float64  `json:"p90"`
+	P99    float64  `json:"p99"`
+}
+
+func (h *Histogram) stat() HistogramStat {
+	st := HistogramStat{Counts: make([]uint64, len(h.counts))}
+	for i := range h.counts {
+		st.Counts[i] = h.counts[i].Load()
+		st.Count += st.Counts[i]
+	}
+	st.SumMs = float64(h.sumUs.Load()) / 1000
+	st.P50, st.P90, st.P99 = st.quantile(0.5), st.quantile(0.9), st.quantile(0.99)
+	return st
+}
+
+func (st *HistogramStat) quantile(q float64) float64 {
+	if st.Count == 0 {
+		return 0
+	}
+	rank := q * float64(st.Count)
+	var seen float64
+	for i, n := range st.Counts {
+		if n == 0 {
+			continue
+		}
+		if seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(Buckets) {
+			return Buckets[i-1]
+		}
+		lo := 0.0
+		if i > 0 {
+			lo = Buckets[i-1]
+		}
+		return math.Round((lo+(Buckets[i]-lo)*(rank-seen)/float64(n))*1000) / 1000
+	}
+	return Buckets[len(Buckets)-1]
+}
+
+// maxHistogramHosts bounds the hosts with their own histograms; later hosts
+// share the otherHosts entry.
+const (
+	maxHistogramHosts = 1000
+	otherHosts        = "_other"
+)
+
+// hostHistograms maps hosts to histograms; lookups of known hosts do not lock.
+type hostHistograms struct {
+	m sync.Map // host -> *Histogram
+	n atomic.Int64
+}
+
+func (hh *hostHistograms) get(host string) *Histogram {
+	if h, ok := hh.m.Load(host); ok {
+		return h.(*Histogram)
+	}
+	if hh.n.Load() >= maxHistogramHosts {
+		host = otherHosts
+	}
+	h, loaded := hh.m.LoadOrStore(host, newHistogram())
+	if !loaded {
+		hh.n.Add(1)
+	}
+	return h.(*Histogram)
+}
+
+func (hh *hostHistograms) stats() map[string]HistogramStat {
+	out := make(map[string]HistogramStat)
+	hh.m.Range(func(k, v any) bool {
+		out[k.(string)] = v.(*Histogram).stat()
+		return true
+	})
+	return out
+}
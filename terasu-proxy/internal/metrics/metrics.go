@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,11 +16,50 @@ func NewMux(agg *Aggregator) *http.ServeMux {
 		_, _ = w.Write([]byte("ok"))
 	})
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// Prometheus scrapers ask for text formats; the controller gets JSON
+		accept := r.Header.Get("Accept")
+		switch r.URL.Query().Get("format") {
+		case "prometheus":
+			accept = "text/plain"
+		case "openmetrics":
+			accept = "application/openmetrics-text"
+		}
+		w.Header().Add("Vary", "Accept")
+		if ct, ok := textFormat(accept); ok {
+			w.Header().Set("Content-Type", ct)
+			_ = WritePrometheus(w, agg.Snapshot(), ct == contentTypeOpenMetrics)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		// expose the aggregator snapshot in a stable JSON that matches GUI models
 		snap := agg.Snapshot()
 		_ = json.NewEncoder(w).Encode(snap)
 	})
+	mux.HandleFunc("/metrics/series", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		window, step := time.Hour, time.Minute
+		var err error
+		if v := q.Get("window"); v != "" {
+			if window, err = parseSpan(v); err != nil {
+				http.Error(w, "bad window: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("step"); v != "" {
+			if step, err = parseSpan(v); err != nil {
+				http.Error(w, "bad step: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		top, _ := strconv.Atoi(q.Get("hosts"))
+		series, err := agg.Series(window, step, top)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(series)
+	})
 	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -49,3 +90,13 @@ func NewMux(agg *Aggregator) *http.ServeMux {
 	})
 	return mux
 }
+
+// parseSpan parses a duration, also in whole days such as "7d".
+func parseSpan(v string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(v, "d"); ok {
+		if n, err := strconv.Atoi(d); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(v)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import "sync/atomic"
+
+// PoolStat is the upstream connection pool state of a host. Active counts
+// requests in flight; with HTTP/2 several of them may share a connection,
+// so Idle is the number of open connections beyond Active, never negative.
+type PoolStat struct {
+	Open    int64 `json:"open"`
+	Active  int64 `json:"active"`
+	Idle    int64 `json:"idle"`
+	Dialing int64 `json:"dialing"`
+}
+
+// PoolGauge tracks the connection pool of one upstream host.
+type PoolGauge struct {
+	open    atomic.Int64
+	active  atomic.Int64
+	dialing atomic.Int64
+}
+
+// DialStart marks a connection attempt; call DialDone when it finishes.
+func (g *PoolGauge) DialStart() { g.dialing.Add(1) }
+
+// DialDone ends a connection attempt; ok adds an open connection.
+func (g *PoolGauge) DialDone(ok bool) {
+	g.dialing.Add(-1)
+	if ok {
+		g.open.Add(1)
+	}
+}
+
+// Closed removes an open connection.
+func (g *PoolGauge) Closed() { g.open.Add(-1) }
+
+// Acquire marks a request in flight; call Release when its body is done.
+func (g *PoolGauge) Acquire() { g.active.Add(1) }
+
+func (g *PoolGauge) Release() { g.active.Add(-1) }
+
+func (g *PoolGauge) stat() PoolStat {
+	st := PoolStat{Open: g.open.Load(), Active: g.active.Load(), Dialing: g.dialing.Load()}
+	if st.Idle = st.Open - st.Active; st.Idle < 0 {
+		st.Idle = 0
+	}
+	return st
+}
+
+// Pool returns the pool gauge of an upstream host, creating it on first use.
+// Gauges are never dropped, since callers keep them while connections are
+// open; past maxHistogramHosts, new hosts share the otherHosts gauge.
+func (a *Aggregator) Pool(host string) *PoolGauge {
+	a.poolMu.Lock()
+	defer a.poolMu.Unlock()
+	if _, ok := a.pools[host]; !ok && len(a.pools) >= maxHistogramHosts {
+		host = otherHosts
+	}
+	g, ok := a.pools[host]
+	if !ok {
+		g = &PoolGauge{}
+		a.pools[host] = g
+	}
+	return g
+}
+
+// poolStats returns the hosts whose pools currently hold or open connections.
+func (a *Aggregator) poolStats() map[string]PoolStat {
+	a.poolMu.Lock()
+	defer a.poolMu.Unlock()
+	var out map[string]PoolStat
+	for host, g := range a.pools {
+		st := g.stat()
+		if st.Open == 0 && st.Active == 0 && st.Dialing == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]PoolStat)
+		}
+		out[host] = st
+	}
+	return out
+}
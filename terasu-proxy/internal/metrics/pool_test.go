@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPoolHostsBounded(t *testing.T) {
+	a := NewAggregator()
+	for i := 0; i < maxHistogramHosts+50; i++ {
+		g := a.Pool(fmt.Sprintf("h%d.test", i))
+		g.Acquire()
+		g.Release()
+	}
+	if n := len(a.pools); n > maxHistogramHosts+1 {
+		t.Fatalf("%d pool gauges kept, want at most %d", n, maxHistogramHosts+1)
+	}
+	if a.Pool("h0.test") == a.Pool(otherHosts) {
+		t.Error("a known host moved to the shared gauge")
+	}
+	late := a.Pool("late.test")
+	if late != a.Pool(otherHosts) {
+		t.Error("a host past the limit has its own gauge")
+	}
+	late.Acquire()
+	if st := a.poolStats()[otherHosts]; st.Active != 1 {
+		t.Errorf("shared gauge = %+v, want one active request", st)
+	}
+}
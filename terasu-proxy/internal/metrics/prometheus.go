@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// maxPromHosts bounds the host label values; the hosts with the fewest
+// requests are summed under otherHosts.
+const maxPromHosts = 50
+
+// textFormat picks the exposition format from an Accept header: OpenMetrics
+// or the Prometheus text format when asked for, JSON otherwise.
+func textFormat(accept string) (contentType string, ok bool) {
+	text := false
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/openmetrics-text":
+			return contentTypeOpenMetrics, true
+		case "text/plain":
+			text = true
+		}
+	}
+	if text {
+		return contentTypeText, true
+	}
+	return "", false
+}
+
+// promWriter writes metric families in the Prometheus text format, or in
+// OpenMetrics, which names counter families without the _total suffix and
+// ends with # EOF.
+type promWriter struct {
+	w  *bufio.Writer
+	om bool
+}
+
+type label struct{ name, value string }
+
+func (p *promWriter) family(name, typ, help string) {
+	if typ == "counter" && !p.om {
+		name += "_total"
+	}
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name string, v float64, labels ...label) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, "%s=\"%s\"", l.name, escapeLabel(l.value))
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteByte(' ')
+	p.w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+// histogram writes a duration histogram in seconds from one in milliseconds.
+func (p *promWriter) histogram(name string, st HistogramStat, labels ...label) {
+	var cum uint64
+	for i, n := range st.Counts {
+		cum += n
+		le := "+Inf"
+		if i < len(Buckets) {
+			le = strconv.FormatFloat(Buckets[i]/1000, 'g', -1, 64)
+		}
+		p.sample(name+"_bucket", float64(cum), append(labels[:len(labels):len(labels)], label{"le", le})...)
+	}
+	p.sample(name+"_count", float64(st.Count), labels...)
+	p.sample(name+"_sum", st.SumMs/1000, labels...)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// WritePrometheus writes a snapshot and Go runtime metrics in the
+// Prometheus text format, or in OpenMetrics when om is set.
+func WritePrometheus(out io.Writer, s Snapshot, om bool) error {
+	p := &promWriter{w: bufio.NewWriter(out), om: om}
+
+	p.family("terasu_proxy_uptime_seconds", "gauge", "Seconds since the proxy started.")
+	p.sample("terasu_proxy_uptime_seconds", float64(s.UptimeSec))
+
+	p.family("terasu_proxy_requests", "counter", "Requests and tunnels handled.")
+	p.sample("terasu_proxy_requests_total", float64(s.TotalRequests))
+
+	p.family("terasu_proxy_bytes", "counter", "Body bytes moved; in is from upstream, out is to upstream.")
+	p.sample("terasu_proxy_bytes_total", float64(s.BytesIn), label{"direction", "in"})
+	p.sample("terasu_proxy_bytes_total", float64(s.BytesOut), label{"direction", "out"})
+
+	p.family("terasu_proxy_responses", "counter", "Requests by status code; 0 is a failed round trip.")
+	for _, code := range sortedKeys(s.Codes) {
+		p.sample("terasu_proxy_responses_total", float64(s.Codes[code]), label{"code", strconv.Itoa(code)})
+	}
+
+	p.family("terasu_proxy_errors", "counter", "Failed round trips and tunnel dials by error class.")
+	for _, class := range sortedKeys(s.Errors) {
+		p.sample("terasu_proxy_errors_total", float64(s.Errors[class]), label{"class", class})
+	}
+
+	hosts := topHosts(s.Hosts)
+	p.family("terasu_proxy_host_requests", "counter", "Requests by upstream host.")
+	for _, h := range hosts {
+		p.sample("terasu_proxy_host_requests_total", float64(h.Req), label{"host", h.name})
+	}
+	p.family("terasu_proxy_host_bytes", "counter", "Body bytes by upstream host.")
+	for _, h := range hosts {
+		p.sample("terasu_proxy_host_bytes_total", float64(h.BytesIn), label{"host", h.name}, label{"direction", "in"})
+		p.sample("terasu_proxy_host_bytes_total", float64(h.BytesOut), label{"host", h.name}, label{"direction", "out"})
+	}
+	p.family("terasu_proxy_host_errors", "counter", "Failures by upstream host and error class.")
+	for _, h := range hosts {
+		for _, class := range sortedKeys(h.Errors) {
+			p.sample("terasu_proxy_host_errors_total", float64(h.Errors[class]), label{"host", h.name}, label{"class", class})
+		}
+	}
+
+	p.family("terasu_proxy_active_connections", "gauge", "Open CONNECT tunnels and MITM sessions.")
+	for _, kind := range sortedKeys(s.Active) {
+		p.sample("terasu_proxy_active_connections", float64(s.Active[kind]), label{"kind", kind})
+	}
+
+	p.family("terasu_proxy_upstream_connections", "gauge", "Upstream pool connections by host and state.")
+	for _, host := range sortedKeys(s.Pools) {
+		st := s.Pools[host]
+		for _, v := range []struct {
+			state string
+			n     int64
+		}{{"open", st.Open}, {"active", st.Active}, {"idle", st.Idle}, {"dialing", st.Dialing}} {
+			p.sample("terasu_proxy_upstream_connections", float64(v.n), label{"host", host}, label{"state", v.state})
+		}
+	}
+
+	p.family("terasu_proxy_breaker_open", "gauge", "Upstream hosts whose circuit breaker is not closed.")
+	for _, host := range sortedKeys(s.Breakers) {
+		p.sample("terasu_proxy_breaker_open", 1, label{"host", host}, label{"state", s.Breakers[host].State})
+	}
+
+	p.family("terasu_proxy_request_duration_seconds", "histogram", "Request durations, tunnels excluded.")
+	p.histogram("terasu_proxy_request_duration_seconds", s.Latency)
+	p.family("terasu_proxy_host_request_duration_seconds", "histogram", "Request durations by upstream host.")
+	for _, h := range hosts {
+		if h.Latency != nil {
+			p.histogram("terasu_proxy_host_request_duration_seconds", *h.Latency, label{"host", h.name})
+		}
+	}
+
+	writeRuntime(p)
+	if om {
+		p.w.WriteString("# EOF\n")
+	}
+	return p.w.Flush()
+}
+
+func writeRuntime(p *promWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.family("go_info", "gauge", "Go version.")
+	p.sample("go_info", 1, label{"version", runtime.Version()})
+	p.family("go_goroutines", "gauge", "Number of goroutines.")
+	p.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	p.family("go_memstats_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	p.sample("go_memstats_heap_alloc_bytes", float64(ms.HeapAlloc))
+	p.family("go_memstats_sys_bytes", "gauge", "Bytes obtained from the OS.")
+	p.sample("go_memstats_sys_bytes", float64(ms.Sys))
+	p.family("go_gc_cycles", "counter", "Completed GC cycles.")
+	p.sample("go_gc_cycles_total", float64(ms.NumGC))
+	p.family("go_gc_pause_seconds", "counter", "Total GC stop-the-world pause.")
+	p.sample("go_gc_pause_seconds_total", float64(ms.PauseTotalNs)/1e9)
+}
+
+type namedHost struct {
+	name string
+	hostStat
+}
+
+// topHosts returns the busiest hosts, the rest summed under otherHosts.
+// Their latency histograms are kept only for the hosts listed by name.
+func topHosts(hosts map[string]hostStat) []namedHost {
+	out := make([]namedHost, 0, len(hosts))
+	for name, h := range hosts {
+		out = append(out, namedHost{name, h})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Req != out[j].Req {
+			return out[i].Req > out[j].Req
+		}
+		return out[i].name < out[j].name
+	})
+	if len(out) <= maxPromHosts {
+		return out
+	}
+	other := namedHost{name: otherHosts, hostStat: hostStat{Errors: make(map[string]uint64)}}
+	for _, h := range out[maxPromHosts-1:] {
+		other.Req += h.Req
+		other.BytesIn += h.BytesIn
+		other.BytesOut += h.BytesOut
+		for c, n := range h.Errors {
+			other.Errors[c] += n
+		}
+	}
+	return append(out[:maxPromHosts-1], other)
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
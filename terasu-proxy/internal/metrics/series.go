@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// seriesTiers are the resolutions of the rolled up series and how long
+// each is kept.
+var seriesTiers = []struct {
+	res, keep time.Duration
+}{
+	{time.Second, 10 * time.Minute},
+	{time.Minute, 24 * time.Hour},
+	{time.Hour, 7 * 24 * time.Hour},
+}
+
+const (
+	// maxSeriesHosts bounds the hosts counted apart in one bucket; the rest
+	// share the otherHosts entry.
+	maxSeriesHosts = 50
+	// maxSeriesPoints bounds the points of one query.
+	maxSeriesPoints = 1440
+	defaultTopHosts = 10
+)
+
+// seriesCounts are the totals of one bucket. Latency counts request
+// durations by Buckets, tunnels left out.
+type seriesCounts struct {
+	req, bytesIn, bytesOut, errors uint64
+	latency                        []uint64
+	sumMs                          float64
+}
+
+func (c *seriesCounts) add(ev RequestEvent) {
+	c.req++
+	if ev.BytesIn > 0 {
+		c.bytesIn += uint64(ev.BytesIn)
+	}
+	if ev.BytesOut > 0 {
+		c.bytesOut += uint64(ev.BytesOut)
+	}
+	if ev.ErrorClass != "" {
+		c.errors++
+	}
+	if ev.Method == "CONNECT" {
+		return
+	}
+	if c.latency == nil {
+		c.latency = make([]uint64, len(Buckets)+1)
+	}
+	c.latency[bucketOf(float64(ev.Ms))]++
+	c.sumMs += math.Max(float64(ev.Ms), 0)
+}
+
+func (c *seriesCounts) merge(o *seriesCounts) {
+	c.req += o.req
+	c.bytesIn += o.bytesIn
+	c.bytesOut += o.bytesOut
+	c.errors += o.errors
+	c.sumMs += o.sumMs
+	if o.latency != nil {
+		if c.latency == nil {
+			c.latency = make([]uint64, len(Buckets)+1)
+		}
+		for i, n := range o.latency {
+			c.latency[i] += n
+		}
+	}
+}
+
+func (c *seriesCounts) point(ts time.Time) SeriesPoint {
+	p := SeriesPoint{Ts: ts, Requests: c.req, BytesIn: c.bytesIn, BytesOut: c.bytesOut, Errors: c.errors}
+	st := HistogramStat{Counts: c.latency}
+	for _, n := range c.latency {
+		st.Count += n
+	}
+	if st.Count > 0 {
+		p.Latency = SeriesLatency{
+			Count: st.Count,
+			AvgMs: math.Round(c.sumMs/float64(st.Count)*1000) / 1000,
+			P50:   st.quantile(0.5),
+			P90:   st.quantile(0.9),
+			P99:   st.quantile(0.99),
+		}
+	}
+	return p
+}
+
+type seriesSlot struct {
+	start int64 // unix seconds of the bucket start; stale slots are reset
+	total seriesCounts
+	hosts map[string]*seriesCounts
+}
+
+type seriesTier struct {
+	res   time.Duration
+	slots []seriesSlot
+}
+
+// series keeps the events rolled up in ring buffers, one per tier.
+type series struct {
+	mu    sync.Mutex
+	tiers []*seriesTier
+}
+
+func newSeries() *series {
+	s := &series{}
+	for _, t := range seriesTiers {
+		s.tiers = append(s.tiers, &seriesTier{res: t.res, slots: make([]seriesSlot, t.keep/t.res)})
+	}
+	return s
+}
+
+func (s *series) add(ev RequestEvent, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tiers {
+		sl := t.slot(now)
+		sl.total.add(ev)
+		host := ev.Host
+		if _, ok := sl.hosts[host]; !ok && len(sl.hosts) >= maxSeriesHosts {
+			host = otherHosts
+		}
+		hc := sl.hosts[host]
+		if hc == nil {
+			hc = &seriesCounts{}
+			sl.hosts[host] = hc
+		}
+		hc.add(ev)
+	}
+}
+
+// slot returns the slot of the bucket holding now, reset if it held an
+// older bucket.
+func (t *seriesTier) slot(now time.Time) *seriesSlot {
+	start := now.Truncate(t.res).Unix()
+	sl := &t.slots[int(start/int64(t.res/time.Second))%len(t.slots)]
+	if sl.start != start {
+		*sl = seriesSlot{start: start, hosts: make(map[string]*seriesCounts)}
+	}
+	return sl
+}
+
+// lookup returns the slot of the bucket starting at start, or nil when it
+// is empty or has been overwritten.
+func (t *seriesTier) lookup(start int64) *seriesSlot {
+	sl := &t.slots[int(start/int64(t.res/time.Second))%len(t.slots)]
+	if sl.start != start {
+		return nil
+	}
+	return sl
+}
+
+// SeriesPoint is one step of a series; Ts is its start.
+type SeriesPoint struct {
+	Ts       time.Time     `json:"ts"`
+	Requests uint64        `json:"requests"`
+	BytesIn  uint64        `json:"bytesIn"`
+	BytesOut uint64        `json:"bytesOut"`
+	Errors   uint64        `json:"errors"`
+	Latency  SeriesLatency `json:"latency"`
+}
+
+// SeriesLatency summarizes request durations in milliseconds; percentiles
+// are interpolated within Buckets.
+type SeriesLatency struct {
+	Count uint64  `json:"count"`
+	AvgMs float64 `json:"avgMs"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+// Series is a rolled up view of the recent events: global points and the
+// points of the busiest hosts of the window.
+type Series struct {
+	WindowSec int64                    `json:"windowSec"`
+	StepSec   int64                    `json:"stepSec"`
+	Points    []SeriesPoint            `json:"points"`
+	Hosts     map[string][]SeriesPoint `json:"hosts"`
+}
+
+// Series returns window up to now in steps of step, from the coarsest tier
+// fine enough for step, with the top hosts by requests. The window is cut
+// to what the tier keeps and the last point is the step in progress.
+func (a *Aggregator) Series(window, step time.Duration, top int) (Series, error) {
+	if step < time.Second {
+		return Series{}, errors.New("step must be at least 1s")
+	}
+	if window < step {
+		return Series{}, errors.New("window must not be shorter than step")
+	}
+	if top <= 0 {
+		top = defaultTopHosts
+	}
+	s := a.series
+	var t *seriesTier
+	for _, tt := range s.tiers {
+		if tt.res <= step && step%tt.res == 0 {
+			t = tt
+		}
+	}
+	if t == nil {
+		return Series{}, errors.New("step must be a multiple of 1s, 1m or 1h")
+	}
+	if keep := t.res * time.Duration(len(t.slots)); window > keep {
+		window = keep
+	}
+	n := int(window / step)
+	if n > maxSeriesPoints {
+		return Series{}, errors.New("too many points; use a larger step or a shorter window")
+	}
+	end := time.Now().Truncate(step)
+	first := end.Add(-time.Duration(n-1) * step)
+	per := int(step / t.res)
+
+	total := make([]seriesCounts, n)
+	hosts := make(map[string][]seriesCounts)
+	s.mu.Lock()
+	for i := 0; i < n; i++ {
+		ts := first.Add(time.Duration(i) * step)
+		for j := 0; j < per; j++ {
+			sl := t.lookup(ts.Add(time.Duration(j) * t.res).Unix())
+			if sl == nil {
+				continue
+			}
+			total[i].merge(&sl.total)
+			for h, c := range sl.hosts {
+				if hosts[h] == nil {
+					hosts[h] = make([]seriesCounts, n)
+				}
+				hosts[h][i].merge(c)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	out := Series{WindowSec: int64(time.Duration(n) * step / time.Second), StepSec: int64(step / time.Second),
+		Points: make([]SeriesPoint, n), Hosts: make(map[string][]SeriesPoint)}
+	for i := range total {
+		out.Points[i] = total[i].point(first.Add(time.Duration(i) * step).UTC())
+	}
+	for _, h := range busiest(hosts, top) {
+		pts := make([]SeriesPoint, n)
+		for i := range pts {
+			pts[i] = hosts[h][i].point(first.Add(time.Duration(i) * step).UTC())
+		}
+		out.Hosts[h] = pts
+	}
+	return out, nil
+}
+
+// busiest returns the top hosts by requests over all points.
+func busiest(hosts map[string][]seriesCounts, top int) []string {
+	type ranked struct {
+		host string
+		req  uint64
+	}
+	rs := make([]ranked, 0, len(hosts))
+	for h, cs := range hosts {
+		r := ranked{host: h}
+		for i := range cs {
+			r.req += cs[i].req
+		}
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].req != rs[j].req {
+			return rs[i].req > rs[j].req
+		}
+		return rs[i].host < rs[j].host
+	})
+	if len(rs) > top {
+		rs = rs[:top]
+	}
+	out := make([]string, len(rs))
+	for i, r := range rs {
+		out[i] = r.host
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Timing is the phase breakdown of one upstream request, in milliseconds.
+// Dial phases are zero when the connection was reused or dialed for another
+// request; Send runs from getting the connection to the request written,
+// TTFB from there to the first response byte.
+type Timing struct {
+	DNS      float64 `json:"dns,omitempty"`
+	Connect  float64 `json:"connect,omitempty"`
+	TLS      float64 `json:"tls,omitempty"`
+	Send     float64 `json:"send,omitempty"`
+	TTFB     float64 `json:"ttfb,omitempty"`
+	Transfer float64 `json:"transfer,omitempty"`
+	Reused   bool    `json:"reused,omitempty"`
+	// Fragmented is set when the TLS handshake used terasu fragmentation.
+	Fragmented bool `json:"fragmented,omitempty"`
+	// Resolver is the dns mode used, or "parent <name>" via a parent proxy.
+	Resolver string `json:"resolver,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+// Phases are the Timing fields kept as per-host histograms.
+var Phases = []string{"dns", "connect", "tls", "ttfb", "transfer"}
+
+func (t *Timing) phase(name string) (float64, bool) {
+	switch name {
+	case "dns":
+		return t.DNS, t.DNS > 0
+	case "connect":
+		return t.Connect, t.Connect > 0
+	case "tls":
+		return t.TLS, t.TLS > 0
+	case "ttfb":
+		return t.TTFB, t.TTFB > 0
+	case "transfer":
+		return t.Transfer, t.Transfer > 0
+	}
+	return 0, false
+}
+
+// Timer collects the Timing of a request from several layers.
+type Timer struct {
+	mu    sync.Mutex
+	t     Timing
+	got   time.Time // connection obtained
+	wrote time.Time // request written
+	first time.Time // first response byte
+}
+
+type timerKey struct{}
+
+// WithTimer attaches a new Timer to ctx.
+func WithTimer(ctx context.Context) (context.Context, *Timer) {
+	t := &Timer{}
+	return context.WithValue(ctx, timerKey{}, t), t
+}
+
+// TimerFrom returns the Timer of ctx, or nil; Timer methods accept nil.
+func TimerFrom(ctx context.Context) *Timer {
+	t, _ := ctx.Value(timerKey{}).(*Timer)
+	return t
+}
+
+// Update changes the timing under the timer's lock.
+func (t *Timer) Update(fn func(*Timing)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	fn(&t.t)
+	t.mu.Unlock()
+}
+
+// Since returns the milliseconds elapsed since start.
+func Since(start time.Time) float64 { return ms(time.Since(start)) }
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+func (t *Timer) gotConn() {
+	t.mu.Lock()
+	t.got = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *Timer) wroteRequest() {
+	t.mu.Lock()
+	t.wrote = time.Now()
+	if !t.got.IsZero() {
+		t.t.Send = ms(t.wrote.Sub(t.got))
+	}
+	t.mu.Unlock()
+}
+
+func (t *Timer) firstByte() {
+	t.mu.Lock()
+	t.first = time.Now()
+	if !t.wrote.IsZero() {
+		t.t.TTFB = ms(t.first.Sub(t.wrote))
+	}
+	t.mu.Unlock()
+}
+
+// done sets the transfer time once the response body is closed.
+func (t *Timer) done() {
+	t.mu.Lock()
+	if !t.first.IsZero() {
+		t.t.Transfer = ms(time.Since(t.first))
+	}
+	t.mu.Unlock()
+}
+
+// Timing returns a copy of the timing collected so far, or nil.
+func (t *Timer) Timing() *Timing {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.t
+	return &c
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import "time"
+
+// Totals are the lifetime counters of an aggregator, saved and restored
+// across restarts. Latency counts are bucketed by Buckets.
+type Totals struct {
+	Taken    time.Time
+	Since    time.Time
+	Requests uint64
+	BytesIn  uint64
+	BytesOut uint64
+	Codes    map[int]uint64
+	Errors   map[string]uint64
+	Hosts    map[string]HostTotals
+	Latency  HistogramTotals
+}
+
+type HostTotals struct {
+	Req      uint64
+	BytesIn  uint64
+	BytesOut uint64
+	Errors   map[string]uint64
+	Latency  HistogramTotals
+}
+
+type HistogramTotals struct {
+	Counts []uint64
+	SumUs  uint64
+}
+
+func (h *Histogram) totals() HistogramTotals {
+	t := HistogramTotals{Counts: make([]uint64, len(h.counts)), SumUs: h.sumUs.Load()}
+	for i := range h.counts {
+		t.Counts[i] = h.counts[i].Load()
+	}
+	return t
+}
+
+// restore adds saved counts; they are skipped if the buckets changed.
+func (h *Histogram) restore(t HistogramTotals) {
+	if len(t.Counts) != len(h.counts) {
+		return
+	}
+	for i, n := range t.Counts {
+		h.counts[i].Add(n)
+	}
+	h.sumUs.Add(t.SumUs)
+}
+
+// Totals returns the counters of finished requests and tunnels.
+func (a *Aggregator) Totals() Totals {
+	t := Totals{
+		Taken:   time.Now().UTC(),
+		Since:   a.since,
+		Codes:   make(map[int]uint64),
+		Errors:  make(map[string]uint64),
+		Hosts:   make(map[string]HostTotals),
+		Latency: a.latency.totals(),
+	}
+	a.mu.Lock()
+	t.Requests = a.totalRequests.Load()
+	t.BytesIn, t.BytesOut = a.bytesIn.Load(), a.bytesOut.Load()
+	for k, v := range a.codes {
+		t.Codes[k] = v
+	}
+	for k, v := range a.errors {
+		t.Errors[k] = v
+	}
+	for host, hs := range a.hosts {
+		ht := HostTotals{Req: hs.Req, BytesIn: hs.BytesIn, BytesOut: hs.BytesOut}
+		if hs.Errors != nil {
+			ht.Errors = make(map[string]uint64, len(hs.Errors))
+			for c, n := range hs.Errors {
+				ht.Errors[c] = n
+			}
+		}
+		t.Hosts[host] = ht
+	}
+	a.mu.Unlock()
+	a.hostLatency.m.Range(func(k, v any) bool {
+		ht := t.Hosts[k.(string)]
+		ht.Latency = v.(*Histogram).totals()
+		t.Hosts[k.(string)] = ht
+		return true
+	})
+	return t
+}
+
+// Restore adds saved totals to the counters and refills the recent events
+// replayed to new subscribers. Call it before serving.
+func (a *Aggregator) Restore(t Totals, recent []RequestEvent) {
+	if !t.Since.IsZero() {
+		a.since = t.Since
+	}
+	a.totalRequests.Add(t.Requests)
+	a.bytesIn.Add(t.BytesIn)
+	a.bytesOut.Add(t.BytesOut)
+	a.latency.restore(t.Latency)
+	a.mu.Lock()
+	for k, v := range t.Codes {
+		a.codes[k] += v
+	}
+	for k, v := range t.Errors {
+		a.errors[k] += v
+	}
+	for host, ht := range t.Hosts {
+		hs := a.hosts[host]
+		hs.Req += ht.Req
+		hs.BytesIn += ht.BytesIn
+		hs.BytesOut += ht.BytesOut
+		for c, n := range ht.Errors {
+			if hs.Errors == nil {
+				hs.Errors = make(map[string]uint64)
+			}
+			hs.Errors[c] += n
+		}
+		a.hosts[host] = hs
+	}
+	all := append(append([]RequestEvent(nil), recent...), a.buf...)
+	if len(all) > recentEvents {
+		all = all[len(all)-recentEvents:]
+	}
+	a.buf = append(make([]RequestEvent, 0, recentEvents), all...)
+	a.mu.Unlock()
+	for host, ht := range t.Hosts {
+		if ht.Latency.Counts != nil {
+			a.hostLatency.get(host).restore(ht.Latency)
+		}
+	}
+}
+
+// Recent returns the events kept in memory, oldest first.
+func (a *Aggregator) Recent() []RequestEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]RequestEvent(nil), a.buf...)
+}
+
+// Record sets fn to receive every event counted from now on.
+func (a *Aggregator) Record(fn func(RequestEvent)) {
+	a.mu.Lock()
+	a.record = fn
+	a.mu.Unlock()
+}
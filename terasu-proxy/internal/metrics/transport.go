@@ -1,8 +1,12 @@
 package metrics
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"time"
 )
 
@@ -28,6 +32,8 @@ func (c *countingReadCloser) Close() error {
 type Transport struct {
 	Base http.RoundTripper
 	Agg  *Aggregator
+	// Classify names the class of a round trip error for RequestEvent.ErrorClass.
+	Classify func(error) string
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -36,6 +42,26 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		base = http.DefaultTransport
 	}
 	start := time.Now()
+	// a layer above may have attached the timer to read it back
+	ctx := WithAnnotations(req.Context())
+	tm := TimerFrom(ctx)
+	if tm == nil {
+		ctx, tm = WithTimer(ctx)
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			tm.gotConn()
+			tm.Update(func(t *Timing) {
+				t.Reused = info.Reused
+				if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+					t.IP = host
+				}
+			})
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { tm.wroteRequest() },
+		GotFirstResponseByte: tm.firstByte,
+	})
+	req = req.WithContext(ctx)
 	// count request body bytes actually sent to upstream if any
 	var reqCount *countingReadCloser
 	if req.Body != nil {
@@ -51,7 +77,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		// record failure quickly
 		if t.Agg != nil {
-			t.Agg.Add(RequestEvent{
+			ev := RequestEvent{
 				Ts:       time.Now().UTC(),
 				Host:     host,
 				Method:   req.Method,
@@ -60,7 +86,18 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				Ms:       time.Since(start).Milliseconds(),
 				BytesIn:  0,
 				BytesOut: 0,
-			})
+			}
+			var cve *tls.CertificateVerificationError
+			if errors.As(err, &cve) {
+				ev.VerifyError = cve.Error()
+			}
+			ev.Error = err.Error()
+			ev.Timing = tm.Timing()
+			if t.Classify != nil {
+				ev.ErrorClass = t.Classify(err)
+			}
+			applyAnnotations(req.Context(), &ev)
+			t.Agg.Add(ev)
 		}
 		return resp, err
 	}
@@ -73,7 +110,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			if reqCount != nil {
 				bout = reqCount.n
 			}
-			t.Agg.Add(RequestEvent{
+			ev := RequestEvent{
 				Ts:       time.Now().UTC(),
 				Host:     host,
 				Method:   req.Method,
@@ -82,7 +119,11 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				Ms:       time.Since(start).Milliseconds(),
 				BytesIn:  total,
 				BytesOut: bout,
-			})
+			}
+			tm.done()
+			ev.Timing = tm.Timing()
+			applyAnnotations(req.Context(), &ev)
+			t.Agg.Add(ev)
 		}
 		resp.Body = rb
 	}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Tunnel is an open CONNECT tunnel. Its bytes count in snapshots while it
+// is open, so that long transfers show before the tunnel ends.
+type Tunnel struct {
+	a       *Aggregator
+	host    string
+	start   time.Time
+	in, out atomic.Int64
+}
+
+// OpenTunnel registers a tunnel to host; call Close when it ends.
+func (a *Aggregator) OpenTunnel(host string) *Tunnel {
+	t := &Tunnel{a: a, host: host, start: time.Now()}
+	a.mu.Lock()
+	a.tunnels[t] = struct{}{}
+	a.mu.Unlock()
+	return t
+}
+
+// AddIn counts bytes from the server to the client.
+func (t *Tunnel) AddIn(n int64) { t.in.Add(n) }
+
+// AddOut counts bytes from the client to the server.
+func (t *Tunnel) AddOut(n int64) { t.out.Add(n) }
+
+// Event returns the tunnel's event so far, completed by ev.
+func (t *Tunnel) Event(ev RequestEvent) RequestEvent {
+	ev.Ts = time.Now().UTC()
+	ev.Host = t.host
+	ev.Ms = time.Since(t.start).Milliseconds()
+	ev.BytesIn, ev.BytesOut = t.in.Load(), t.out.Load()
+	return ev
+}
+
+// Progress sends the tunnel's event so far to subscribers, marked as
+// progress; it is not counted as a request.
+func (t *Tunnel) Progress(ev RequestEvent) {
+	ev = t.Event(ev)
+	ev.Progress = true
+	t.a.publish(ev)
+}
+
+// Close unregisters the tunnel and records its final event. Both happen
+// under one lock, so that no snapshot misses the tunnel's bytes.
+func (t *Tunnel) Close(ev RequestEvent) {
+	ev = t.Event(ev)
+	a := t.a
+	a.mu.Lock()
+	delete(a.tunnels, t)
+	phases, record := a.add(ev)
+	a.mu.Unlock()
+	a.added(ev, phases, record)
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTunnelCloseKeepsBytes(t *testing.T) {
+	a := NewAggregator()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var last uint64
+		for {
+			s := a.Snapshot()
+			if s.BytesIn < last {
+				t.Errorf("bytesIn went from %d to %d", last, s.BytesIn)
+				return
+			}
+			last = s.BytesIn
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		tn := a.OpenTunnel("example.com:443")
+		tn.AddIn(100)
+		tn.AddOut(10)
+		tn.Close(RequestEvent{Method: "CONNECT", Code: 200})
+	}
+	close(done)
+	wg.Wait()
+	if s := a.Snapshot(); s.BytesIn != 2000*100 || s.BytesOut != 2000*10 {
+		t.Errorf("bytes = %d/%d, want %d/%d", s.BytesIn, s.BytesOut, 2000*100, 2000*10)
+	}
+}
@@ -15,10 +15,11 @@ type CertStore struct {
     ca   *CA
     mu   sync.Mutex
     cache map[string]*tls.Certificate
+    untrusted map[string]*tls.Certificate
 }
 
 func NewCertStore(ca *CA) *CertStore {
-    return &CertStore{ca: ca, cache: make(map[string]*tls.Certificate)}
+    return &CertStore{ca: ca, cache: make(map[string]*tls.Certificate), untrusted: make(map[string]*tls.Certificate)}
 }
 
 func (s *CertStore) GetCertificate(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
@@ -58,3 +59,34 @@ func (s *CertStore) signLeaf(host string) (*tls.Certificate, error) {
 }
 
 
+
+// UntrustedCertificate returns a self-signed leaf for host that clients will
+// reject, used to mirror upstream verification failures to the client.
+func (s *CertStore) UntrustedCertificate(host string) (*tls.Certificate, error) {
+    if host == "" { host = "unknown" }
+    s.mu.Lock()
+    if crt, ok := s.untrusted[host]; ok {
+        s.mu.Unlock()
+        return crt, nil
+    }
+    s.mu.Unlock()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil { return nil, err }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: host, Organization: []string{"terasu-proxy upstream verification failed"}},
+        DNSNames: []string{host},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter:  time.Now().AddDate(0,0,7),
+        KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil { return nil, err }
+    crt := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+    s.mu.Lock()
+    s.untrusted[host] = crt
+    s.mu.Unlock()
+    return crt, nil
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"terasu-proxy/internal/auth"
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/har"
+	"terasu-proxy/internal/history"
+	"terasu-proxy/internal/metrics"
+)
+
+// AdminHandler serves the admin API for admin.addr, behind admin.basic_auth
+// when it is set.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.RegisterAdmin(mux)
+	a := s.cfg.Admin.BasicAuth
+	return auth.Basic{Enabled: s.cfg.Admin.AuthEnabled(), Username: a.Username, Password: a.Password}.Require("terasu-proxy admin", mux)
+}
+
+// RegisterAdmin adds the admin API to mux. It can hold flows, kill
+// connections and hand out captured credentials, so mux must not be
+// reachable without the checks of AdminHandler.
+func (s *Server) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/breakpoints", s.handleBreakpoints)
+	mux.HandleFunc("/breakpoints/", s.handleBreakpoint)
+	mux.HandleFunc("/capture.har", s.handleCapture)
+	mux.HandleFunc("/keylog", s.handleKeyLog)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/connections/", s.handleConnections)
+	mux.HandleFunc("/flows", s.handleFlows)
+	mux.HandleFunc("/flows/", s.handleFlow)
+	mux.HandleFunc("/events", s.handleEvents)
+}
+
+const (
+	defaultEventsLimit = 1000
+	maxEventsLimit     = 10000
+)
+
+// handleEvents serves request events from the history log, or from the
+// recent events in memory when history is off. When more events match
+// than limit, next is the cursor of the following page.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := history.ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	after, err := history.ParseCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var evs []metrics.RequestEvent
+	var next history.Cursor
+	if s.history != nil {
+		evs, next = s.history.Query(f, limit, after)
+	} else {
+		evs, next = history.Select(s.stats.Recent(), f, limit, after)
+	}
+	if evs == nil {
+		evs = []metrics.RequestEvent{}
+	}
+	resp := map[string]any{"events": evs}
+	if !next.IsZero() {
+		resp["next"] = next.String()
+	}
+	if n := s.history.Dropped(); n > 0 {
+		resp["dropped"] = n
+	}
+	writeJSON(w, resp)
+}
+
+// handleFlows lists captured flows, filtered by host as for /capture.har.
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if s.capture == nil {
+		http.Error(w, "capture is not enabled by any rule", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.capture.Flows(r.URL.Query().Get("host")))
+}
+
+// handleFlow serves the flows in progress, their lifecycle events and the
+// replay of captured flows.
+func (s *Server) handleFlow(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/flows/")
+	switch rest {
+	case "live":
+		writeJSON(w, s.flows.Live())
+		return
+	case "stream":
+		s.streamFlows(w, r)
+		return
+	}
+	ids, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseUint(ids, 10, 64)
+	if err != nil || action != "replay" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.capture == nil {
+		http.Error(w, "capture is not enabled by any rule", http.StatusNotFound)
+		return
+	}
+	orig, ok := s.capture.Request(id)
+	if !ok {
+		http.Error(w, "no such captured flow", http.StatusNotFound)
+		return
+	}
+	var rr replayRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxBreakBody+4096)).Decode(&rr); err != nil {
+			http.Error(w, "bad replay: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := rr.validate(orig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Infof("replay flow %d: %d times, concurrency %d", id, rr.Count, rr.Concurrency)
+	writeJSON(w, map[string]any{"replay_of": id, "results": s.replay(r.Context(), id, orig, &rr)})
+}
+
+// handleKeyLog streams TLS secrets logged from now on, in the NSS key log
+// format; "# " lines are comments naming connections, or keepalives. The
+// secrets decrypt every logged session, so the stream is only served when
+// the admin API asks for credentials.
+func (s *Server) handleKeyLog(w http.ResponseWriter, r *http.Request) {
+	if s.keylog == nil {
+		http.Error(w, "key log is not enabled", http.StatusNotFound)
+		return
+	}
+	if !s.cfg.Admin.AuthEnabled() {
+		http.Error(w, "key log stream needs admin.basic_auth; read key_log.file instead", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stream unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel := s.keylog.Subscribe()
+	defer cancel()
+	flusher.Flush()
+	notify := r.Context().Done()
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			_, _ = w.Write(line)
+			flusher.Flush()
+		case <-notify:
+			return
+		case <-time.After(30 * time.Second):
+			fmt.Fprint(w, "# keepalive\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// handleCapture exports captured exchanges as HAR. host filters by domain
+// suffix; since is an RFC 3339 time or a duration back from now.
+func (s *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if s.capture == nil {
+		http.Error(w, "capture is not enabled by any rule", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		} else {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="capture.har"`)
+	err := s.capture.WriteHAR(w, r.URL.Query().Get("host"), since, har.Creator{Name: "terasu-proxy", Version: "1.0"})
+	if err != nil {
+		s.log.Debugf("capture export: %v", err)
+	}
+}
+
+// handleBreakpoints lists the paused flows.
+func (s *Server) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.breaks.list())
+}
+
+// handleBreakpoint serves GET /breakpoints/stream and
+// POST /breakpoints/{id}/{resume|reply|drop}.
+func (s *Server) handleBreakpoint(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/breakpoints/")
+	if rest == "stream" {
+		s.streamBreakpoints(w, r)
+		return
+	}
+	id, action, ok := strings.Cut(rest, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case breakResume, breakReply, breakDrop:
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	f := s.breaks.get(id)
+	if f == nil {
+		http.Error(w, "no such paused flow", http.StatusNotFound)
+		return
+	}
+	d := breakDecision{Action: action}
+	if r.ContentLength != 0 && action != breakDrop {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxBreakBody+4096)).Decode(&d); err != nil {
+			http.Error(w, "bad decision: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := d.validate(f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.breaks.release(id, d) {
+		http.Error(w, "no such paused flow", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamBreakpoints sends breakpoint events as server-sent events, starting
+// with the flows already paused.
+func (s *Server) streamBreakpoints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stream unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel := s.breaks.subscribe()
+	defer cancel()
+	for _, f := range s.breaks.list() {
+		b, _ := json.Marshal(breakEvent{Type: "paused", Flow: f})
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+	flusher.Flush()
+	notify := r.Context().Done()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-notify:
+			return
+		case <-time.After(30 * time.Second):
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// streamFlows sends the flows in progress as "live" events, then the
+// lifecycle events published from now on.
+func (s *Server) streamFlows(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stream unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel := s.flows.Subscribe()
+	defer cancel()
+	for _, st := range s.flows.Live() {
+		st := st
+		b, _ := json.Marshal(flow.Event{Type: "live", Ts: time.Now().UTC(), Flow: &st})
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+	flusher.Flush()
+	notify := r.Context().Done()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-notify:
+			return
+		case <-time.After(30 * time.Second):
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/flow"
+)
+
+const (
+	defaultBreakTimeout = 5 * time.Minute
+	// bodies above this size are shown truncated and cannot be edited
+	maxBreakBody = 1 << 20
+)
+
+var errFlowDropped = errors.New("flow dropped at breakpoint")
+
+// breakpoint actions; timeout and gone are set by the proxy itself
+const (
+	breakResume  = "resume"
+	breakReply   = "reply"
+	breakDrop    = "drop"
+	breakTimeout = "timeout"
+	breakGone    = "gone"
+)
+
+// pausedFlow is a request or response held at a breakpoint.
+type pausedFlow struct {
+	ID        string      `json:"id"`
+	Stage     string      `json:"stage"` // request | response
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"headers"`
+	Body      string      `json:"body,omitempty"`
+	Base64    bool        `json:"base64,omitempty"`    // Body holds base64 of a binary body
+	Truncated bool        `json:"truncated,omitempty"` // body too large to show or edit
+	Paused    time.Time   `json:"paused"`
+	Deadline  time.Time   `json:"deadline"`
+
+	done chan breakDecision
+}
+
+func (f *pausedFlow) setBody(p []byte, truncated bool) {
+	switch {
+	case truncated:
+		f.Truncated = true
+	case utf8.Valid(p):
+		f.Body = string(p)
+	default:
+		f.Body, f.Base64 = base64.StdEncoding.EncodeToString(p), true
+	}
+}
+
+// breakDecision releases a paused flow. Empty fields keep the flow's values;
+// Method and URL only apply to requests, Status only to responses and replies.
+type breakDecision struct {
+	Action string      `json:"-"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"headers"`
+	Body   *string     `json:"body"`
+	Base64 bool        `json:"base64"`
+
+	url  *url.URL
+	body []byte
+}
+
+// validate checks the edits against the paused flow and decodes them.
+func (d *breakDecision) validate(f *pausedFlow) error {
+	if d.URL != "" {
+		u, err := url.Parse(d.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q", d.URL)
+		}
+		d.url = u
+	}
+	if d.Status != 0 && (d.Status < 100 || d.Status > 999) {
+		return fmt.Errorf("invalid status %d", d.Status)
+	}
+	if d.Body != nil {
+		if f.Truncated && d.Action != breakReply {
+			return errors.New("body too large to edit")
+		}
+		d.body = []byte(*d.Body)
+		if d.Base64 {
+			p, err := base64.StdEncoding.DecodeString(*d.Body)
+			if err != nil {
+				return fmt.Errorf("body: %w", err)
+			}
+			d.body = p
+		}
+	}
+	return nil
+}
+
+// editRequest returns r with the decision's edits applied.
+func (d *breakDecision) editRequest(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	if d.Method != "" {
+		r.Method = strings.ToUpper(d.Method)
+	}
+	if d.url != nil {
+		r.URL = d.url
+		r.Host = d.url.Host
+	}
+	if d.Header != nil {
+		r.Header = canonicalHeader(d.Header)
+	}
+	if d.Body != nil {
+		p := d.body
+		r.Body = io.NopCloser(bytes.NewReader(p))
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(p)), nil }
+		r.ContentLength = int64(len(p))
+		r.TransferEncoding = nil
+		r.Header.Del("Content-Length")
+	}
+	return r
+}
+
+// editResponse applies the decision's edits to resp.
+func (d *breakDecision) editResponse(resp *http.Response) {
+	if d.Status != 0 {
+		resp.StatusCode = d.Status
+		resp.Status = fmt.Sprintf("%d %s", d.Status, http.StatusText(d.Status))
+	}
+	if d.Header != nil {
+		resp.Header = canonicalHeader(d.Header)
+	}
+	if d.Body != nil {
+		_ = resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(d.body))
+		resp.ContentLength = int64(len(d.body))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(d.body)))
+	}
+}
+
+// canonicalHeader returns h with canonical keys, which JSON decoding keeps
+// as sent. Values of keys that differ only in case are merged.
+func canonicalHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		ck := http.CanonicalHeaderKey(k)
+		out[ck] = append(out[ck], v...)
+	}
+	return out
+}
+
+// breakEvent notifies admin clients of paused and released flows.
+type breakEvent struct {
+	Type string      `json:"type"` // paused | resume | reply | drop | timeout | gone
+	Flow *pausedFlow `json:"flow"`
+}
+
+// breakpoints is the registry of paused flows. A flow is released exactly
+// once: whoever removes it from the registry owns its done channel.
+type breakpoints struct {
+	mu    sync.Mutex
+	flows map[string]*pausedFlow
+
+	subMu sync.Mutex
+	subs  map[chan breakEvent]struct{}
+}
+
+func newBreakpoints() *breakpoints {
+	return &breakpoints{flows: make(map[string]*pausedFlow), subs: make(map[chan breakEvent]struct{})}
+}
+
+// wait pauses f until it is released, its timeout passes or ctx ends.
+func (b *breakpoints) wait(ctx context.Context, f *pausedFlow, timeout time.Duration) breakDecision {
+	if timeout <= 0 {
+		timeout = defaultBreakTimeout
+	}
+	f.Paused = time.Now().UTC()
+	f.Deadline = f.Paused.Add(timeout)
+	f.done = make(chan breakDecision, 1)
+	b.mu.Lock()
+	b.flows[f.ID] = f
+	b.mu.Unlock()
+	b.publish(breakEvent{Type: "paused", Flow: f})
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var action string
+	select {
+	case d := <-f.done:
+		return d
+	case <-t.C:
+		action = breakTimeout
+	case <-ctx.Done():
+		action = breakGone
+	}
+	// when an admin client released it concurrently, its decision wins
+	b.release(f.ID, breakDecision{Action: action})
+	return <-f.done
+}
+
+// get returns a paused flow.
+func (b *breakpoints) get(id string) *pausedFlow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flows[id]
+}
+
+// release hands d to the paused flow id. It reports false when the flow is
+// no longer paused.
+func (b *breakpoints) release(id string, d breakDecision) bool {
+	b.mu.Lock()
+	f := b.flows[id]
+	delete(b.flows, id)
+	b.mu.Unlock()
+	if f == nil {
+		return false
+	}
+	f.done <- d
+	b.publish(breakEvent{Type: d.Action, Flow: f})
+	return true
+}
+
+// list returns the paused flows, oldest first.
+func (b *breakpoints) list() []*pausedFlow {
+	b.mu.Lock()
+	out := make([]*pausedFlow, 0, len(b.flows))
+	for _, f := range b.flows {
+		out = append(out, f)
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Paused.Before(out[j].Paused) })
+	return out
+}
+
+func (b *breakpoints) subscribe() (chan breakEvent, func()) {
+	ch := make(chan breakEvent, 64)
+	b.subMu.Lock()
+	b.subs[ch] = struct{}{}
+	b.subMu.Unlock()
+	return ch, func() {
+		b.subMu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.subMu.Unlock()
+	}
+}
+
+func (b *breakpoints) publish(ev breakEvent) {
+	b.subMu.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	b.subMu.Unlock()
+}
+
+// flowID returns the id of the flow started for a request by forward.
+func flowID(ctx context.Context) string {
+	return strconv.FormatUint(flow.From(ctx).ID(), 10)
+}
+
+type breakpointKey struct{}
+
+// breakRequest holds r at a request breakpoint. It returns the request to
+// forward, or nil when the flow was answered or dropped.
+func (s *Server) breakRequest(w http.ResponseWriter, r *http.Request, bp *config.Breakpoint, path string) *http.Request {
+	p, big, body, err := peekBody(r.Body)
+	if err != nil {
+		http.Error(w, "read request body", http.StatusBadRequest)
+		return nil
+	}
+	r.Body = body
+	f := &pausedFlow{ID: flowID(r.Context()), Stage: "request", Method: r.Method, URL: r.URL.String(), Header: r.Header.Clone()}
+	f.setBody(p, big)
+	start := time.Now()
+	d := s.breaks.wait(r.Context(), f, bp.Timeout)
+	switch d.Action {
+	case breakGone:
+		return nil
+	case breakDrop:
+		panic(http.ErrAbortHandler)
+	case breakReply:
+		sw := &statusWriter{ResponseWriter: w}
+		for k, v := range d.Header {
+			sw.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+		sw.Header().Set("Content-Length", strconv.Itoa(len(d.body)))
+		status := d.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		sw.WriteHeader(status)
+		_, _ = sw.Write(d.body)
+		s.recordLocal(r, path, sw, start, "breakpoint="+f.ID)
+		return nil
+	case breakResume:
+		return d.editRequest(r)
+	}
+	return r
+}
+
+// breakResponse holds resp at a response breakpoint, applying the edits it
+// is released with.
+func (s *Server) breakResponse(resp *http.Response, bp *config.Breakpoint) error {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	ctx := resp.Request.Context()
+	p, big, body, err := peekBody(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	f := &pausedFlow{
+		ID:     flowID(ctx),
+		Stage:  "response",
+		Method: resp.Request.Method,
+		URL:    resp.Request.URL.String(),
+		Status: resp.StatusCode,
+		Header: resp.Header.Clone(),
+	}
+	f.setBody(p, big)
+	d := s.breaks.wait(ctx, f, bp.Timeout)
+	switch d.Action {
+	case breakGone:
+		return ctx.Err()
+	case breakDrop:
+		return errFlowDropped
+	case breakResume, breakReply:
+		d.editResponse(resp)
+	}
+	return nil
+}
+
+// peekBody reads up to maxBreakBody bytes of body and returns them, whether
+// the body is larger, and a body yielding the full content again.
+func peekBody(body io.ReadCloser) ([]byte, bool, io.ReadCloser, error) {
+	if body == nil || body == http.NoBody {
+		return nil, false, body, nil
+	}
+	p, err := io.ReadAll(io.LimitReader(body, maxBreakBody+1))
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if len(p) > maxBreakBody {
+		return nil, true, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(p), body), body}, nil
+	}
+	_ = body.Close()
+	return p, false, io.NopCloser(bytes.NewReader(p)), nil
+}
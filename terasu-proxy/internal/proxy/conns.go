@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelProgressEvery spaces the progress events of open tunnels in /logs.
+const tunnelProgressEvery = 5 * time.Second
+
+// liveConn is an open CONNECT tunnel or MITM session, listed by
+// /connections. Bytes are counted from the client's point of view.
+type liveConn struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"` // tunnel | mitm
+	Host    string    `json:"host"`
+	Client  string    `json:"client"`
+	Started time.Time `json:"started"`
+
+	bytes  func() (in, out int64)
+	close  func()
+	killed atomic.Bool
+}
+
+type connInfo struct {
+	*liveConn
+	AgeSec   float64 `json:"ageSec"`
+	BytesIn  int64   `json:"bytesIn"`
+	BytesOut int64   `json:"bytesOut"`
+}
+
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*liveConn
+}
+
+// trackConn lists c until the returned func is called.
+func (s *Server) trackConn(c *liveConn) func() {
+	s.conns.mu.Lock()
+	if s.conns.conns == nil {
+		s.conns.conns = make(map[string]*liveConn)
+	}
+	s.conns.conns[c.ID] = c
+	s.conns.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.conns.mu.Lock()
+			if s.conns.conns[c.ID] == c {
+				delete(s.conns.conns, c.ID)
+			}
+			s.conns.mu.Unlock()
+		})
+	}
+}
+
+func (s *Server) connections() []connInfo {
+	s.conns.mu.Lock()
+	out := make([]connInfo, 0, len(s.conns.conns))
+	for _, c := range s.conns.conns {
+		in, sent := c.bytes()
+		out = append(out, connInfo{liveConn: c, AgeSec: time.Since(c.Started).Seconds(), BytesIn: in, BytesOut: sent})
+	}
+	s.conns.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// killConn closes a tunnel or MITM session.
+func (s *Server) killConn(id string) bool {
+	s.conns.mu.Lock()
+	c := s.conns.conns[id]
+	s.conns.mu.Unlock()
+	if c == nil {
+		return false
+	}
+	c.killed.Store(true)
+	c.close()
+	return true
+}
+
+// handleConnections serves GET /connections and DELETE /connections/{id}.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/connections"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, s.connections())
+	case id != "" && r.Method == http.MethodDelete:
+		if !s.killConn(id) {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		s.log.Infof("connection %s killed from the admin API", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// countingConn counts the bytes of a MITM session and reports its close,
+// whichever layer closes it.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+	once          sync.Once
+	onClose       func()
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.once.Do(c.onClose)
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/metrics"
+)
+
+var (
+	errFaultAbort    = errors.New("fault: connection aborted")
+	errThrottleEnded = errors.New("fault: throttled write canceled")
+)
+
+// annotateFault appends an injected fault to the request's event.
+func annotateFault(ctx context.Context, desc string) {
+	metrics.Annotate(ctx, func(ev *metrics.RequestEvent) {
+		ev.Fault = strings.TrimSpace(ev.Fault + " " + desc)
+	})
+}
+
+// faultDelay waits for the configured latency. It reports false when ctx
+// ends first.
+func faultDelay(ctx context.Context, f *config.Fault) (time.Duration, bool) {
+	d := f.Latency
+	if f.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	if d <= 0 {
+		return 0, true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return d, true
+	case <-ctx.Done():
+		return d, false
+	}
+}
+
+// faultHit rolls whether a request gets the status or abort fault.
+func faultHit(f *config.Fault) bool {
+	return f.Percent <= 0 || f.Percent >= 100 || rand.Float64()*100 < f.Percent
+}
+
+// applyFault injects the faults of a rule into a forwarded request. It
+// returns the writer to forward with, or nil when the request was answered.
+func (s *Server) applyFault(w http.ResponseWriter, r *http.Request, f *config.Fault, path string) http.ResponseWriter {
+	ctx := r.Context()
+	if d, ok := faultDelay(ctx, f); !ok {
+		return nil
+	} else if d > 0 {
+		annotateFault(ctx, "latency="+d.Round(time.Millisecond).String())
+	}
+	hit := (f.Status != 0 || f.Abort) && faultHit(f)
+	if hit && f.Status != 0 {
+		start := time.Now()
+		annotateFault(ctx, fmt.Sprintf("status=%d", f.Status))
+		sw := &statusWriter{ResponseWriter: w}
+		http.Error(sw, "fault injected", f.Status)
+		s.recordLocal(r, path, sw, start, "")
+		return nil
+	}
+	if f.Bandwidth > 0 {
+		w = &throttledWriter{ResponseWriter: w, l: s.limiter(r, f), done: ctx.Done()}
+		annotateFault(ctx, fmt.Sprintf("bandwidth=%d", f.Bandwidth))
+	}
+	if hit && f.Abort {
+		w = &abortWriter{ResponseWriter: w, left: f.AbortAfter}
+		annotateFault(ctx, "abort")
+	}
+	return w
+}
+
+// limiterIdle is how long a host limiter goes unused before it is dropped.
+const limiterIdle = time.Minute
+
+// limiter returns the bandwidth limiter shared by the scope of a fault.
+func (s *Server) limiter(r *http.Request, f *config.Fault) *rateLimiter {
+	if f.BandwidthScope == "host" {
+		k := r.URL.Hostname()
+		s.limitersMu.Lock()
+		defer s.limitersMu.Unlock()
+		if now := time.Now(); now.Sub(s.limitersSwept) >= limiterIdle {
+			s.evictLimiters(now)
+			s.limitersSwept = now
+		}
+		m := s.limiters[f]
+		if m == nil {
+			m = make(map[string]*rateLimiter)
+			s.limiters[f] = m
+		}
+		if l, ok := m[k]; ok {
+			return l
+		}
+		l := newRateLimiter(f.Bandwidth)
+		m[k] = l
+		return l
+	}
+	if cs, _ := r.Context().Value(connStateKey{}).(*connState); cs != nil {
+		return cs.limiter(f)
+	}
+	return newRateLimiter(f.Bandwidth)
+}
+
+// evictLimiters drops the host limiters idle since limiterIdle. An idle
+// limiter has no pending schedule, so a new one behaves the same.
+func (s *Server) evictLimiters(now time.Time) {
+	for f, m := range s.limiters {
+		for k, l := range m {
+			if l.idleSince(now.Add(-limiterIdle)) {
+				delete(m, k)
+			}
+		}
+		if len(m) == 0 {
+			delete(s.limiters, f)
+		}
+	}
+}
+
+// connState is attached to every client connection, including MITM
+// sessions, so that per-connection limits span its requests.
+type connState struct {
+	id       string
+	mu       sync.Mutex
+	limiters map[*config.Fault]*rateLimiter
+}
+
+type connStateKey struct{}
+
+var connSeq atomic.Uint64
+
+func newConnState() *connState {
+	return &connState{id: "c" + strconv.FormatUint(connSeq.Add(1), 10)}
+}
+
+// connContext gives each accepted client connection its state.
+func (s *Server) connContext(ctx context.Context, c net.Conn) context.Context {
+	cs := newConnState()
+	s.flows.Accepted(cs.id, c.RemoteAddr().String())
+	return context.WithValue(ctx, connStateKey{}, cs)
+}
+
+// connID returns the id of the client connection of ctx, if any.
+func connID(ctx context.Context) string {
+	if cs, _ := ctx.Value(connStateKey{}).(*connState); cs != nil {
+		return cs.id
+	}
+	return ""
+}
+
+func (cs *connState) limiter(f *config.Fault) *rateLimiter {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.limiters == nil {
+		cs.limiters = make(map[*config.Fault]*rateLimiter)
+	}
+	l, ok := cs.limiters[f]
+	if !ok {
+		l = newRateLimiter(f.Bandwidth)
+		cs.limiters[f] = l
+	}
+	return l
+}
+
+// rateLimiter schedules writes so that their total stays under a byte rate.
+type rateLimiter struct {
+	rate float64 // bytes per second
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(bps int64) *rateLimiter { return &rateLimiter{rate: float64(bps)} }
+
+// idleSince reports whether the limiter had nothing scheduled after t.
+func (l *rateLimiter) idleSince(t time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next.Before(t)
+}
+
+// chunk is the largest write scheduled at once, about 1/10 s of traffic.
+func (l *rateLimiter) chunk() int {
+	if n := int(l.rate / 10); n > 512 {
+		return n
+	}
+	return 512
+}
+
+// wait blocks until n more bytes may be sent. It reports false when done
+// is closed first, giving the reserved time back to later writes.
+func (l *rateLimiter) wait(done <-chan struct{}, n int) bool {
+	slot := time.Duration(float64(n) / l.rate * float64(time.Second))
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(slot)
+	l.mu.Unlock()
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		l.mu.Lock()
+		l.next = l.next.Add(-slot)
+		l.mu.Unlock()
+		return false
+	}
+}
+
+// write sends p through w at the limiter's rate, until done is closed.
+func (l *rateLimiter) write(done <-chan struct{}, w io.Writer, p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := len(p)
+		if max := l.chunk(); c > max {
+			c = max
+		}
+		if !l.wait(done, c) {
+			return n, errThrottleEnded
+		}
+		m, err := w.Write(p[:c])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+	}
+	return n, nil
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	l    *rateLimiter
+	done <-chan struct{} // of the request context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) { return w.l.write(w.done, w.ResponseWriter, p) }
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// abortWriter fails once left body bytes have been written. The reverse
+// proxy then aborts the handler, which resets the client connection; end
+// does the same when the body was too short to reach the limit.
+type abortWriter struct {
+	http.ResponseWriter
+	left    int64
+	aborted bool
+}
+
+func (w *abortWriter) WriteHeader(code int) {
+	if w.left == 0 {
+		// no body byte goes out, so the client must not see it as complete
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *abortWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.left {
+		n, _ := w.ResponseWriter.Write(p[:w.left])
+		w.left = 0
+		w.aborted = true
+		w.Flush()
+		return n, errFaultAbort
+	}
+	w.left -= int64(len(p))
+	return w.ResponseWriter.Write(p)
+}
+
+// end aborts a response that reached the limit without exceeding it, such
+// as an empty body with abort_after 0. It runs when the handler returns.
+func (w *abortWriter) end() {
+	if w.aborted || w.left > 0 {
+		return
+	}
+	w.aborted = true
+	panic(http.ErrAbortHandler)
+}
+
+func (w *abortWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *abortWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// throttledConn limits the bytes written to a tunnel side.
+type throttledConn struct {
+	io.Writer
+	l    *rateLimiter
+	done <-chan struct{} // closed with the tunnel
+}
+
+func (c throttledConn) Write(p []byte) (int, error) { return c.l.write(c.done, c.Writer, p) }
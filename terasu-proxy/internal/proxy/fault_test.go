@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(1000)
+	if !l.wait(nil, 1000) {
+		t.Fatal("first wait canceled")
+	}
+	done := make(chan struct{})
+	close(done)
+	start := time.Now()
+	if l.wait(done, 1000) {
+		t.Fatal("wait not canceled")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("canceled wait took %v", d)
+	}
+	l.mu.Lock()
+	ahead := time.Until(l.next)
+	l.mu.Unlock()
+	if ahead > 1100*time.Millisecond {
+		t.Errorf("canceled wait kept its slot: next is %v ahead", ahead)
+	}
+
+	var buf bytes.Buffer
+	n, err := l.write(done, &buf, make([]byte, 100))
+	if err != errThrottleEnded || n != 0 || buf.Len() != 0 {
+		t.Errorf("write = %d, %v with %d bytes sent, want 0, %v", n, err, buf.Len(), errThrottleEnded)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/rules"
+)
+
+// finishFlow ends f when forward returns; it is deferred so that it also
+// sees aborted handlers, whose panic it passes on.
+func finishFlow(f *flow.Flow) {
+	if v := recover(); v != nil {
+		f.Fail("aborted")
+		f.Finish()
+		panic(v)
+	}
+	f.Finish()
+}
+
+func ruleNames(rs []*rules.Rule) []string {
+	var out []string
+	for _, r := range rs {
+		if r.Name != "" {
+			out = append(out, r.Name)
+		}
+	}
+	return out
+}
+
+// flowWriter reports the response sent to the client to its flow.
+type flowWriter struct {
+	http.ResponseWriter
+	f       *flow.Flow
+	started bool
+}
+
+func (w *flowWriter) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if !w.started && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.started = true
+		w.f.Response(code, w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *flowWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.f.AddIn(int64(n))
+	return n, err
+}
+
+func (w *flowWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *flowWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flowBody counts the request body read from the client.
+type flowBody struct {
+	io.ReadCloser
+	f *flow.Flow
+}
+
+func (b *flowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.f.AddOut(int64(n))
+	return n, err
+}
+
+// progressWriter counts the bytes copied through a tunnel.
+type progressWriter struct {
+	io.Writer
+	add func(int64)
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.add(int64(n))
+	return n, err
+}
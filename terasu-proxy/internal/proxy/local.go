@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/egress"
+	"terasu-proxy/internal/har"
+	"terasu-proxy/internal/metrics"
+	"terasu-proxy/internal/rules"
+)
+
+// loadStub reads the HAR files replayed by the stub server.
+func loadStub(sc config.Stub) (*har.Replayer, error) {
+	var hs []*har.HAR
+	for _, path := range sc.HAR {
+		h, err := har.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, h)
+	}
+	return har.NewReplayer(hs...), nil
+}
+
+// serveMock answers a request with the canned response of a mock rule.
+func (s *Server) serveMock(w http.ResponseWriter, r *http.Request, rule *rules.Rule, path string) {
+	start := time.Now()
+	m := rule.Mock
+	if m.Delay > 0 {
+		t := time.NewTimer(m.Delay)
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			s.recordLocal(r, path, &statusWriter{ResponseWriter: w}, start, "mock="+rule.Name)
+			return
+		}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	body := []byte(m.Body)
+	if m.BodyFile != "" {
+		b, err := os.ReadFile(m.BodyFile)
+		if err != nil {
+			s.log.Warnf("mock %q: %v", rule.Name, err)
+			http.Error(sw, "mock body unavailable", http.StatusInternalServerError)
+			s.recordLocal(r, path, sw, start, "mock="+rule.Name)
+			return
+		}
+		body = b
+	}
+	for k, v := range m.Headers {
+		sw.Header().Set(k, v)
+	}
+	sw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	sw.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = sw.Write(body)
+	}
+	s.recordLocal(r, path, sw, start, "mock="+rule.Name)
+}
+
+// serveStub replays a recorded HAR entry. It reports false when no entry
+// matches and the request may still go upstream.
+func (s *Server) serveStub(w http.ResponseWriter, r *http.Request, path string) bool {
+	if s.stub.Len() == 0 && !s.cfg.Stub.Strict {
+		return false
+	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	e := s.stub.Find(r.Method, r.URL)
+	if e == nil {
+		if !s.cfg.Stub.Strict {
+			return false
+		}
+		http.Error(sw, fmt.Sprintf("no recorded response for %s %s", r.Method, r.URL), http.StatusNotFound)
+		s.recordLocal(r, path, sw, start, "stub=miss")
+		return true
+	}
+	body, err := e.Response.Content.Bytes()
+	if err != nil {
+		http.Error(sw, "bad recorded body", http.StatusInternalServerError)
+		s.recordLocal(r, path, sw, start, "stub=error")
+		return true
+	}
+	for _, h := range e.Response.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Keep-Alive":
+			// the recorded body is stored decoded
+			continue
+		}
+		if len(h.Name) > 0 && h.Name[0] == ':' {
+			continue // HTTP/2 pseudo headers
+		}
+		sw.Header().Add(h.Name, h.Value)
+	}
+	sw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	sw.WriteHeader(e.Response.Status)
+	if r.Method != http.MethodHead {
+		_, _ = sw.Write(body)
+	}
+	s.recordLocal(r, path, sw, start, "stub="+e.Request.URL)
+	return true
+}
+
+// recordLocal records an event for a response produced by the proxy itself.
+func (s *Server) recordLocal(r *http.Request, path string, sw *statusWriter, start time.Time, upstream string) {
+	if s.stats == nil {
+		return
+	}
+	ev := metrics.RequestEvent{
+		Ts:       time.Now().UTC(),
+		Host:     r.URL.Hostname(),
+		Method:   r.Method,
+		Path:     path,
+		Code:     sw.status(),
+		Ms:       time.Since(start).Milliseconds(),
+		BytesIn:  sw.n,
+		Upstream: upstream,
+	}
+	if err := r.Context().Err(); err != nil && sw.code == 0 {
+		// the client left before anything was written
+		ev.Code, ev.ErrorClass, ev.Error = 0, egress.Classify(err), err.Error()
+	}
+	metrics.Apply(r.Context(), &ev)
+	s.stats.Add(ev)
+}
+
+// statusWriter records the status and size of a locally produced response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
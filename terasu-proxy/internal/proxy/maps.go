@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"terasu-proxy/internal/rules"
+)
+
+// serveLocal answers a request from the file or directory of a map_local
+// rule. http.ServeContent provides content types, conditional and range
+// requests.
+func (s *Server) serveLocal(w http.ResponseWriter, r *http.Request, rule *rules.Rule, path string) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	name := rule.MapLocal.Path
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		name = filepath.Join(name, filepath.FromSlash(pathpkg.Clean(rule.Rest(path))))
+		if fi, err = os.Stat(name); err == nil && fi.IsDir() {
+			name = filepath.Join(name, "index.html")
+			fi, err = os.Stat(name)
+		}
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		s.log.Debugf("map_local %s %s: %v", r.Method, r.URL, err)
+		http.NotFound(sw, r)
+	} else {
+		defer f.Close()
+		http.ServeContent(sw, r, fi.Name(), fi.ModTime(), f)
+	}
+	s.recordLocal(r, path, sw, start, "local="+name)
+}
+
+// mapRemote points a request at the upstream URL of a map_remote rule. The
+// client keeps seeing its original URL.
+func mapRemote(r *http.Request, rule *rules.Rule, path string) *http.Request {
+	target, _ := url.Parse(rule.MapRemote.URL) // validated by NewServer
+	u := *r.URL
+	u.Scheme, u.Host = target.Scheme, target.Host
+	u.Path = strings.TrimSuffix(target.Path, "/") + rule.Rest(path)
+	u.RawPath = ""
+	if target.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery = target.RawQuery + "&" + u.RawQuery
+		} else {
+			u.RawQuery = target.RawQuery
+		}
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL = &u
+	r2.Host = u.Host
+	return r2
+}
+
+// validateMaps checks map_remote URLs up front.
+func validateMaps(rs []*rules.Rule) error {
+	for _, r := range rs {
+		if r.MapRemote == nil {
+			continue
+		}
+		u, err := url.Parse(r.MapRemote.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule %q: invalid map_remote url %q", r.Name, r.MapRemote.URL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"terasu-proxy/internal/capture"
+)
+
+const (
+	maxReplays           = 1000
+	maxReplayConcurrency = 50
+)
+
+// replayRequest resends a captured flow, with the edits of a breakpoint
+// decision applied to its request.
+type replayRequest struct {
+	breakDecision
+	Count       int `json:"count"`       // default 1
+	Concurrency int `json:"concurrency"` // default 1
+}
+
+// replayResult is the outcome of one resend. Flow is the id of the new
+// captured flow, empty when the request never reached the upstream.
+type replayResult struct {
+	Flow   uint64 `json:"flow,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Ms     int64  `json:"ms"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+// validate checks the edits against the captured request and the counts.
+func (rr *replayRequest) validate(orig *capture.Request) error {
+	if rr.Count == 0 {
+		rr.Count = 1
+	}
+	if rr.Concurrency == 0 {
+		rr.Concurrency = 1
+	}
+	if rr.Count < 0 || rr.Count > maxReplays {
+		return errors.New("count must be between 1 and 1000")
+	}
+	if rr.Concurrency < 0 || rr.Concurrency > maxReplayConcurrency {
+		return errors.New("concurrency must be between 1 and 50")
+	}
+	if rr.Concurrency > rr.Count {
+		rr.Concurrency = rr.Count
+	}
+	if orig.Truncated && rr.Body == nil {
+		return errors.New("captured body was truncated; send a body to replay")
+	}
+	rr.Action = breakResume
+	if err := rr.breakDecision.validate(&pausedFlow{}); err != nil {
+		return err
+	}
+	// an edited url keeps the origin of the captured flow, so that replay
+	// cannot reach hosts the client never did
+	if rr.url != nil {
+		o, err := url.Parse(orig.URL)
+		if err != nil {
+			return err
+		}
+		if rr.url.Scheme != o.Scheme || !strings.EqualFold(rr.url.Host, o.Host) {
+			return fmt.Errorf("url must stay on %s://%s", o.Scheme, o.Host)
+		}
+	}
+	return nil
+}
+
+// replay resends a captured request count times through forward, so that
+// rules apply as for client requests, and links the new flows to id. The
+// resends come from the original client and share a connection, so that
+// per-connection limits span them.
+func (s *Server) replay(ctx context.Context, id uint64, orig *capture.Request, rr *replayRequest) []replayResult {
+	u, err := url.Parse(orig.URL)
+	if err != nil {
+		return []replayResult{{Error: err.Error()}}
+	}
+	ctx = withClient(ctx, client{ip: orig.Client.IP, user: orig.Client.User})
+	ctx = context.WithValue(ctx, connStateKey{}, newConnState())
+	results := make([]replayResult, rr.Count)
+	sem := make(chan struct{}, rr.Concurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(res *replayResult) {
+			defer func() { <-sem; wg.Done() }()
+			r, err := http.NewRequestWithContext(capture.Replay(ctx, id, func(id uint64) { res.Flow = id }), orig.Method, u.String(), bytes.NewReader(orig.Body))
+			if err != nil {
+				res.Error = err.Error()
+				return
+			}
+			r.Header = orig.Header.Clone()
+			r.RemoteAddr = "replay"
+			r = rr.editRequest(r)
+			s.replayOne(r, res)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *Server) replayOne(r *http.Request, res *replayResult) {
+	start := time.Now()
+	w := &replayWriter{header: make(http.Header)}
+	defer func() {
+		res.Ms = time.Since(start).Milliseconds()
+		res.Status, res.Bytes = w.status, w.n
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			res.Error = "aborted"
+		}
+	}()
+	s.forward(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+}
+
+// replayWriter discards the replayed response, keeping its status and size.
+type replayWriter struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+func (w *replayWriter) Header() http.Header { return w.header }
+
+func (w *replayWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (w *replayWriter) Flush() {}
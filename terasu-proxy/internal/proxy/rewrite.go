@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/rewrite"
+	"terasu-proxy/internal/rules"
+)
+
+// client identifies the downstream client of a request. Requests inside a
+// MITM session inherit it from their CONNECT.
+type client struct {
+	ip   string
+	user string
+}
+
+type clientKey struct{}
+
+func (s *Server) clientOf(r *http.Request) client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return client{ip: ip, user: s.auth.User(r)}
+}
+
+func withClient(ctx context.Context, c client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+func clientFrom(ctx context.Context) client {
+	c, _ := ctx.Value(clientKey{}).(client)
+	return c
+}
+
+// rewrites holds the header and body rewrites chosen for a request.
+type rewrites struct {
+	headers []*config.HeaderRewrite
+	bodies  []*rewrite.Body
+	vars    rewrite.Vars
+}
+
+type rewritesKey struct{}
+
+// compileBodies compiles the body rewrites of rs, keyed by their config.
+func compileBodies(rs []*rules.Rule) (map[*config.BodyRewrite]*rewrite.Body, error) {
+	bodies := make(map[*config.BodyRewrite]*rewrite.Body)
+	for _, r := range rs {
+		if r.Body == nil {
+			continue
+		}
+		b, err := rewrite.NewBody(*r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		bodies[r.Body] = b
+	}
+	return bodies, nil
+}
+
+// rewritesFor collects the rewrites of the matched rules, or returns nil
+// when there are none.
+func (s *Server) rewritesFor(r *http.Request, matched []*rules.Rule, host, path string) *rewrites {
+	hs, bs := rules.Headers(matched), rules.Bodies(matched)
+	if len(hs) == 0 && len(bs) == 0 {
+		return nil
+	}
+	c := clientFrom(r.Context())
+	rw := &rewrites{headers: hs, vars: rewrite.Vars{
+		ClientIP: c.ip,
+		User:     c.user,
+		Host:     host,
+		Method:   r.Method,
+		Path:     path,
+	}}
+	for _, b := range bs {
+		rw.bodies = append(rw.bodies, s.bodies[b])
+	}
+	return rw
+}
+
+// rewriteRequest applies request header rewrites in the Director.
+func rewriteRequest(r *http.Request) {
+	rw, _ := r.Context().Value(rewritesKey{}).(*rewrites)
+	if rw == nil {
+		return
+	}
+	for _, h := range rw.headers {
+		if host := rewrite.Headers(r.Header, h.Request, rw.vars); host != "" {
+			r.Host = host
+		}
+	}
+}
+
+// modifyResponse runs the response rewrites and then a response breakpoint.
+func (s *Server) modifyResponse(resp *http.Response) error {
+	if err := rewriteResponse(resp); err != nil {
+		return err
+	}
+	if bp, _ := resp.Request.Context().Value(breakpointKey{}).(*config.Breakpoint); bp != nil && bp.Response {
+		return s.breakResponse(resp, bp)
+	}
+	return nil
+}
+
+// rewriteResponse applies body and response header rewrites before the
+// response is copied to the client.
+func rewriteResponse(resp *http.Response) error {
+	rw, _ := resp.Request.Context().Value(rewritesKey{}).(*rewrites)
+	if rw == nil {
+		return nil
+	}
+	if len(rw.bodies) > 0 {
+		if err := rewrite.Bodies(resp, rw.bodies); err != nil {
+			return err
+		}
+	}
+	for _, h := range rw.headers {
+		rewrite.Headers(resp.Header, h.Response, rw.vars)
+	}
+	return nil
+}
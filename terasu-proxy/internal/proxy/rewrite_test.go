@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"terasu-proxy/internal/auth"
+	"terasu-proxy/internal/config"
+	"terasu-proxy/internal/rules"
+)
+
+func TestRewrites(t *testing.T) {
+	rs := []config.Rule{
+		{
+			Name:  "api",
+			Match: config.Match{Hosts: []string{"example.com"}},
+			Headers: &config.HeaderRewrite{
+				Request:  config.HeaderOps{Set: map[string]string{"X-Route": "${method} ${host}${path}"}},
+				Response: config.HeaderOps{Remove: []string{"Server"}},
+			},
+		},
+		{
+			Name:  "admin-path",
+			Match: config.Match{Hosts: []string{"example.com"}, Paths: []string{"/admin"}},
+			Headers: &config.HeaderRewrite{
+				Request: config.HeaderOps{Add: map[string]string{"X-User": "${user}@${client_ip}"}},
+			},
+		},
+		{
+			Name:  "writes",
+			Match: config.Match{Methods: []string{"post", "PUT"}},
+			Headers: &config.HeaderRewrite{
+				Request:  config.HeaderOps{Remove: []string{"Cookie"}},
+				Response: config.HeaderOps{Add: map[string]string{"X-Write": "${method}"}},
+			},
+		},
+		{
+			Name:  "vhost",
+			Match: config.Match{Hosts: []string{"old.test"}},
+			Headers: &config.HeaderRewrite{
+				Request: config.HeaderOps{Set: map[string]string{"Host": "new.test"}},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		wantReq  http.Header
+		wantHost string
+		wantResp http.Header
+	}{
+		{
+			name:     "host suffix",
+			method:   "GET",
+			url:      "http://api.example.com/v1",
+			wantReq:  http.Header{"Cookie": {"a=1"}, "X-Route": {"GET api.example.com/v1"}},
+			wantHost: "api.example.com",
+			wantResp: http.Header{},
+		},
+		{
+			name:   "host and path prefix",
+			method: "GET",
+			url:    "http://example.com/admin/users",
+			wantReq: http.Header{
+				"Cookie":  {"a=1"},
+				"X-Route": {"GET example.com/admin/users"},
+				"X-User":  {"alice@192.0.2.1"},
+			},
+			wantHost: "example.com",
+			wantResp: http.Header{},
+		},
+		{
+			name:     "method",
+			method:   "POST",
+			url:      "http://other.test/form",
+			wantReq:  http.Header{},
+			wantHost: "other.test",
+			wantResp: http.Header{"Server": {"upstream"}, "X-Write": {"POST"}},
+		},
+		{
+			name:     "host and method",
+			method:   "PUT",
+			url:      "http://example.com/v1",
+			wantReq:  http.Header{"X-Route": {"PUT example.com/v1"}},
+			wantHost: "example.com",
+			wantResp: http.Header{"X-Write": {"PUT"}},
+		},
+		{
+			name:     "host header",
+			method:   "GET",
+			url:      "http://old.test/",
+			wantReq:  http.Header{"Cookie": {"a=1"}},
+			wantHost: "new.test",
+			wantResp: http.Header{"Server": {"upstream"}},
+		},
+		{
+			name:     "no match",
+			method:   "GET",
+			url:      "http://other.test/admin",
+			wantReq:  http.Header{"Cookie": {"a=1"}},
+			wantHost: "other.test",
+			wantResp: http.Header{"Server": {"upstream"}},
+		},
+	}
+	engine := rules.New("all", nil, rs)
+	bodies, err := compileBodies(engine.Rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		rules:  engine,
+		bodies: bodies,
+		auth:   auth.Basic{Enabled: true, Username: "alice", Password: "pw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			r.SetBasicAuth("alice", "pw")
+			r = r.WithContext(withClient(r.Context(), s.clientOf(r)))
+			r.Header = http.Header{"Cookie": {"a=1"}}
+			host, path := r.URL.Hostname(), r.URL.Path
+			ctx := r.Context()
+			if rw := s.rewritesFor(r, s.rules.Match(host, path, r.Method), host, path); rw != nil {
+				ctx = context.WithValue(ctx, rewritesKey{}, rw)
+			}
+			r = r.WithContext(ctx)
+			r.Host = host
+			rewriteRequest(r)
+			if !reflect.DeepEqual(r.Header, tt.wantReq) {
+				t.Errorf("request headers = %v, want %v", r.Header, tt.wantReq)
+			}
+			if r.Host != tt.wantHost {
+				t.Errorf("host = %q, want %q", r.Host, tt.wantHost)
+			}
+			resp := &http.Response{Request: r, Header: http.Header{"Server": {"upstream"}}}
+			if err := rewriteResponse(resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Header, tt.wantResp) {
+				t.Errorf("response headers = %v, want %v", resp.Header, tt.wantResp)
+			}
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -16,24 +18,48 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"terasu-proxy/internal/auth"
+	"terasu-proxy/internal/capture"
 	"terasu-proxy/internal/config"
 	"terasu-proxy/internal/egress"
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/har"
+	"terasu-proxy/internal/history"
+	"terasu-proxy/internal/keylog"
 	"terasu-proxy/internal/metrics"
 	"terasu-proxy/internal/mitm"
+	"terasu-proxy/internal/rewrite"
 	"terasu-proxy/internal/rules"
+	"terasu-proxy/internal/tracing"
 )
 
 type Server struct {
-	srv   *http.Server
-	ln    net.Listener
-	cfg   *config.Config
-	log   *logrus.Logger
-	rules *rules.Engine
-	ca    *mitm.CA
-	store *mitm.CertStore
-	rp    *httputil.ReverseProxy
-	auth  auth.Basic
-	stats *metrics.Aggregator
+	srv    *http.Server
+	ln     net.Listener
+	cfg    *config.Config
+	log    *logrus.Logger
+	rules  *rules.Engine
+	ca     *mitm.CA
+	store  *mitm.CertStore
+	rp     *httputil.ReverseProxy
+	egress *egress.Client
+	auth   auth.Basic
+	stats  *metrics.Aggregator
+	// compiled body rewrites of the configured rules
+	bodies map[*config.BodyRewrite]*rewrite.Body
+	stub   *har.Replayer
+
+	// bandwidth limiters of faults scoped to hosts
+	limitersMu    sync.Mutex
+	limiters      map[*config.Fault]map[string]*rateLimiter
+	limitersSwept time.Time
+
+	breaks  *breakpoints
+	flows   *flow.Bus
+	conns   connRegistry
+	capture *capture.Store
+	keylog  *keylog.Log
+	tracer  *tracing.Tracer
+	history *history.Store
 }
 
 func NewServer(cfg *config.Config, log *logrus.Logger) (*Server, error) {
@@ -45,12 +71,62 @@ func NewServer(cfg *config.Config, log *logrus.Logger) (*Server, error) {
 	store := mitm.NewCertStore(ca)
 
 	// rules
-	re := rules.New(cfg.Mode, cfg.InterceptList)
+	re := rules.New(cfg.Mode, cfg.InterceptList, cfg.Rules)
+	if err := validateMaps(re.Rules); err != nil {
+		return nil, err
+	}
+	stub, err := loadStub(cfg.Stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Stub.HAR) > 0 {
+		log.Infof("stub: %d recorded exchanges from %d har files, strict=%t", stub.Len(), len(cfg.Stub.HAR), cfg.Stub.Strict)
+	}
+	bodies, err := compileBodies(re.Rules)
+	if err != nil {
+		return nil, err
+	}
 
 	agg := metrics.NewAggregator()
+	hist, err := history.Open(cfg.History, agg, log)
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
 
-	baseTransport := egress.Transport(cfg.DNS.Mode)
-	wrapped := &metrics.Transport{Base: baseTransport, Agg: agg}
+	baseTransport, err := egress.New(cfg, log, agg)
+	if err != nil {
+		return nil, err
+	}
+	tracer := tracing.New(cfg.Tracing, log)
+	if tracer != nil {
+		log.Infof("tracing: endpoint=%s sample_ratio=%g propagate=%t", cfg.Tracing.Endpoint, cfg.Tracing.SampleRatio, cfg.Tracing.Propagate)
+	}
+	// a client span per attempt, so it sits under the retrier
+	traced := &tracing.Transport{Base: baseTransport, Classify: egress.Classify}
+	retrier := egress.NewRetrier(traced, cfg.Retry, cfg.Breaker, agg)
+	wrapped := &metrics.Transport{Base: retrier, Agg: agg, Classify: egress.Classify}
+	var captured *capture.Store
+	if rules.Capture(re.Rules) {
+		if captured, err = capture.New(cfg.Capture); err != nil {
+			return nil, err
+		}
+	}
+
+	var kl *keylog.Log
+	if cfg.KeyLog.All || rules.KeyLog(re.Rules) {
+		if kl, err = keylog.Open(cfg.KeyLog.File); err != nil {
+			return nil, err
+		}
+		log.Infof("tls key log: file=%q all=%t stream=%t", cfg.KeyLog.File, cfg.KeyLog.All, cfg.Admin.AuthEnabled())
+		for _, r := range re.Rules {
+			if r.KeyLog && (len(r.Match.Paths) > 0 || len(r.Match.Methods) > 0) {
+				log.Warnf("tls key log: rule %q sets paths or methods; its key_log covers upstream handshakes, but MITM client handshakes match on host only", r.Name)
+			}
+		}
+		if cfg.KeyLog.File == "" && !cfg.Admin.AuthEnabled() {
+			log.Warn("tls key log: no file and GET /keylog needs admin auth, secrets are dropped")
+		}
+	}
 
 	// reverse proxy using terasu transport
 	rp := &httputil.ReverseProxy{
@@ -60,16 +136,31 @@ func NewServer(cfg *config.Config, log *logrus.Logger) (*Server, error) {
 				r.URL.Scheme = "https"
 			}
 			r.Host = r.URL.Host
+			if rt := egress.RouteFrom(r.Context()); rt.Host != "" {
+				r.Host = rt.Host
+			}
 			r.Header.Del("Proxy-Connection")
+			rewriteRequest(r)
 		},
-		Transport:     wrapped,
+		Transport:     &capture.Transport{Base: wrapped, Store: captured},
 		FlushInterval: 50 * time.Millisecond,
 	}
 
-	s := &Server{cfg: cfg, log: log, rules: re, ca: ca, store: store, rp: rp,
-		auth:  auth.Basic{Enabled: cfg.Security.BasicAuth.Enabled, Username: cfg.Security.BasicAuth.Username, Password: cfg.Security.BasicAuth.Password},
-		stats: agg,
+	s := &Server{cfg: cfg, log: log, rules: re, ca: ca, store: store, rp: rp, egress: baseTransport,
+		auth:     auth.Basic{Enabled: cfg.Security.BasicAuth.Enabled, Username: cfg.Security.BasicAuth.Username, Password: cfg.Security.BasicAuth.Password},
+		stats:    agg,
+		bodies:   bodies,
+		stub:     stub,
+		limiters: make(map[*config.Fault]map[string]*rateLimiter),
+		breaks:   newBreakpoints(),
+		flows:    flow.NewBus(),
+		capture:  captured,
+		keylog:   kl,
+		tracer:   tracer,
+		history:  hist,
 	}
+	rp.ModifyResponse = s.modifyResponse
+	rp.ErrorHandler = s.errorHandler
 	s.srv = &http.Server{
 		Addr:           cfg.Listen,
 		Handler:        http.HandlerFunc(s.handle),
@@ -77,6 +168,7 @@ func NewServer(cfg *config.Config, log *logrus.Logger) (*Server, error) {
 		WriteTimeout:   cfg.Limits.WriteTimeout,
 		IdleTimeout:    120 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		ConnContext:    s.connContext,
 	}
 	return s, nil
 }
@@ -95,6 +187,17 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.egress.Close()
+	defer s.tracer.Close()
+	// after the server, so that the last events are logged
+	defer func() {
+		if err := s.history.Close(); err != nil {
+			s.log.Warnf("history: %v", err)
+		}
+	}()
+	if s.keylog != nil {
+		defer s.keylog.Close()
+	}
 	return s.srv.Shutdown(ctx)
 }
 
@@ -116,7 +219,105 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	s.rp.ServeHTTP(w, r)
+	s.forward(w, r.WithContext(withClient(r.Context(), s.clientOf(r))))
+}
+
+// forward sends a proxied request upstream, applying the matching rules.
+// It serves both absolute-form requests and requests inside MITM sessions.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	host := r.URL.Hostname()
+	matched := s.rules.Match(host, path, r.Method)
+	f := s.flows.Start(flow.State{Kind: flow.KindHTTP, Conn: connID(r.Context()), Client: clientFrom(r.Context()).ip,
+		Method: r.Method, Host: host, URL: r.URL.String(), ReplayOf: capture.ReplayOf(r.Context())})
+	r, sp := s.startSpan(r, f, clientFrom(r.Context()))
+	defer endSpan(sp, f)
+	defer finishFlow(f)
+	f.Decide(ruleNames(matched))
+	f.Request(r.Header)
+	w = &flowWriter{ResponseWriter: w, f: f}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &flowBody{ReadCloser: r.Body, f: f}
+	}
+	r = r.WithContext(flow.With(metrics.WithAnnotations(r.Context()), f))
+	metrics.Annotate(r.Context(), func(ev *metrics.RequestEvent) { ev.Flow = f.ID() })
+	if id := connID(r.Context()); id != "" {
+		metrics.Annotate(r.Context(), func(ev *metrics.RequestEvent) { ev.Conn = id })
+		if s.keylog != nil && (s.cfg.KeyLog.All || rules.KeyLog(matched)) {
+			r = r.WithContext(keylog.WithConn(r.Context(), s.keylog, id))
+		}
+	}
+	if f := rules.Fault(matched); f != nil {
+		if w = s.applyFault(w, r, f, path); w == nil {
+			return
+		}
+		if aw, ok := w.(*abortWriter); ok {
+			defer aw.end()
+		}
+	}
+	if bp := rules.Breakpoint(matched); bp != nil {
+		r = r.WithContext(context.WithValue(r.Context(), breakpointKey{}, bp))
+		if bp.Request {
+			if r = s.breakRequest(w, r, bp, path); r == nil {
+				return
+			}
+		}
+	}
+	if rule := rules.Mock(matched); rule != nil {
+		s.serveMock(w, r, rule, path)
+		return
+	}
+	if rule := rules.MapLocal(matched); rule != nil {
+		s.serveLocal(w, r, rule, path)
+		return
+	}
+	if s.serveStub(w, r, path) {
+		return
+	}
+	var desc []string
+	if rule := rules.MapRemote(matched); rule != nil {
+		r = mapRemote(r, rule, path)
+		desc = append(desc, "remote="+r.URL.String())
+	}
+	route := routeFor(matched)
+	ctx := egress.WithRoute(r.Context(), route)
+	if route.Overridden() {
+		desc = append(desc, route.String())
+	}
+	if len(desc) > 0 {
+		d := strings.Join(desc, " ")
+		s.log.Debugf("upstream override %s %s: %s", r.Method, host, d)
+		metrics.Annotate(ctx, func(ev *metrics.RequestEvent) { ev.Upstream = d })
+	}
+	if rw := s.rewritesFor(r, matched, host, path); rw != nil {
+		ctx = context.WithValue(ctx, rewritesKey{}, rw)
+	}
+	if rules.Capture(matched) {
+		ctx = capture.Enable(ctx)
+	}
+	if c := clientFrom(ctx); c != (client{}) {
+		ctx = capture.WithClient(ctx, capture.Client{IP: c.ip, User: c.user})
+	}
+	s.rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// routeFor derives the egress route from the matched rules.
+func routeFor(matched []*rules.Rule) egress.Route {
+	rt := egress.Route{Parents: rules.Parents(matched)}
+	if up := rules.Upstream(matched); up != nil {
+		rt.Connect = up.Connect
+		rt.SNI = up.SNI
+		rt.NoSNI = up.NoSNI
+		rt.Host = up.Host
+		rt.VerifyName = up.VerifyName
+	}
+	if f := rules.HTTPFragment(matched); f != nil {
+		rt.Fragment = egress.HTTPFragment{Enabled: true, MixCase: f.MixCase, Delay: f.Delay}
+	}
+	return rt
 }
 
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
@@ -146,50 +347,111 @@ func (s *Server) tunnel(w http.ResponseWriter, r *http.Request, target string) {
 		return
 	}
 	defer clientConn.Close()
-	_, _ = io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n")
 
-	// dial target
+	// dial target, through parent proxies when a rule selects them, and
+	// only then answer the CONNECT
+	host, _, _ := net.SplitHostPort(target)
+	if host == "" {
+		host = target
+	}
+	matched := s.rules.Match(host, "", "")
+	fl := s.flows.Start(flow.State{Kind: flow.KindTunnel, Conn: connID(r.Context()), Client: s.clientOf(r).ip,
+		Method: http.MethodConnect, Host: host, URL: target})
+	r, sp := s.startSpan(r, fl, s.clientOf(r))
+	defer endSpan(sp, fl)
+	defer fl.Finish()
+	fl.Decide(ruleNames(matched))
+	fl.Request(r.Header)
+	var faults []string
+	var lim *rateLimiter
+	if f := rules.Fault(matched); f != nil {
+		d, ok := faultDelay(r.Context(), f)
+		if !ok {
+			fl.Fail("client gone")
+			return
+		}
+		if d > 0 {
+			faults = append(faults, "latency="+d.Round(time.Millisecond).String())
+		}
+		if f.Bandwidth > 0 {
+			lim = s.limiter(r, f)
+			faults = append(faults, fmt.Sprintf("bandwidth=%d", f.Bandwidth))
+		}
+	}
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	d := net.Dialer{Timeout: 10 * time.Second}
-	serverConn, err := d.DialContext(ctx, "tcp", target)
+	ctx = egress.WithRoute(ctx, routeFor(matched))
+	start := time.Now()
+	serverConn, err := s.egress.Dial(ctx, "tcp", target)
 	if err != nil {
+		s.log.Debugf("tunnel %s: %v", target, err)
+		fl.Fail(err.Error())
+		_, _ = io.WriteString(clientConn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		s.stats.Add(metrics.RequestEvent{
+			Ts:         time.Now().UTC(),
+			Host:       host,
+			Method:     http.MethodConnect,
+			Path:       "/",
+			Ms:         time.Since(start).Milliseconds(),
+			Fault:      strings.Join(faults, " "),
+			ErrorClass: egress.Classify(err),
+			Error:      err.Error(),
+			Conn:       connID(r.Context()),
+			Flow:       fl.ID(),
+		})
 		return
 	}
 	defer serverConn.Close()
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		fl.Fail(err.Error())
+		return
+	}
+	fl.Response(http.StatusOK, nil)
+
+	// the tunnel shows in metrics, /logs and /connections while it is open
+	mt := s.stats.OpenTunnel(host)
+	ev := metrics.RequestEvent{Method: http.MethodConnect, Path: "/", Code: 200,
+		Fault: strings.Join(faults, " "), Conn: connID(r.Context()), Flow: fl.ID()}
+	// closed ends throttled writes waiting for their turn
+	closed, closeTunnel := context.WithCancel(context.Background())
+	defer closeTunnel()
+	lc := &liveConn{ID: ev.Conn, Kind: flow.KindTunnel, Host: target, Client: clientConn.RemoteAddr().String(), Started: time.Now(),
+		bytes: func() (int64, int64) { e := mt.Event(ev); return e.BytesIn, e.BytesOut },
+		close: func() { closeTunnel(); clientConn.Close(); serverConn.Close() }}
+	defer s.trackConn(lc)()
+
+	var toServer, toClient io.Writer = serverConn, clientConn
+	if lim != nil {
+		toServer = throttledConn{Writer: serverConn, l: lim, done: closed.Done()}
+		toClient = throttledConn{Writer: clientConn, l: lim, done: closed.Done()}
+	}
+	toServer = progressWriter{Writer: toServer, add: func(n int64) { fl.AddOut(n); mt.AddOut(n) }}
+	toClient = progressWriter{Writer: toClient, add: func(n int64) { fl.AddIn(n); mt.AddIn(n) }}
 
-	start := time.Now()
-	var up, down int64 // up: client->server, down: server->client
 	done := make(chan struct{}, 2)
 	go func() {
-		n, _ := io.Copy(serverConn, clientConn)
-		up = n
+		_, _ = io.Copy(toServer, clientConn)
 		done <- struct{}{}
 	}()
 	go func() {
-		n, _ := io.Copy(clientConn, serverConn)
-		down = n
+		_, _ = io.Copy(toClient, serverConn)
 		done <- struct{}{}
 	}()
-	<-done
-	<-done
-	// record a CONNECT event for visibility in metrics/logs
-	host, _, _ := net.SplitHostPort(target)
-	if host == "" {
-		host = target
+	tick := time.NewTicker(tunnelProgressEvery)
+	defer tick.Stop()
+	for n := 0; n < 2; {
+		select {
+		case <-done:
+			n++
+		case <-tick.C:
+			mt.Progress(ev)
+		}
 	}
-	if s.stats != nil {
-		s.stats.Add(metrics.RequestEvent{
-			Ts:       time.Now().UTC(),
-			Host:     host,
-			Method:   http.MethodConnect,
-			Path:     "/",
-			Code:     200,
-			Ms:       time.Since(start).Milliseconds(),
-			BytesIn:  down,
-			BytesOut: up,
-		})
+	if lc.killed.Load() {
+		fl.Fail("killed")
+		ev.Fault = strings.TrimSpace(ev.Fault + " killed")
 	}
+	mt.Close(ev)
 }
 
 func (s *Server) mitm(w http.ResponseWriter, r *http.Request, target string) {
@@ -202,22 +464,49 @@ func (s *Server) mitm(w http.ResponseWriter, r *http.Request, target string) {
 	if err != nil {
 		return
 	}
+	c := s.clientOf(r)
 	// write 200 first
 	_, _ = io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n")
 
-	tlsSrv := tls.Server(clientConn, &tls.Config{
-		GetCertificate: s.store.GetCertificate,
+	// the session runs on the hijacked client connection and keeps its id
+	cs, _ := r.Context().Value(connStateKey{}).(*connState)
+	if cs == nil {
+		cs = newConnState()
+		s.flows.Accepted(cs.id, clientConn.RemoteAddr().String())
+	}
+	cc := &countingConn{Conn: clientConn}
+	lc := &liveConn{ID: cs.id, Kind: flow.KindMITM, Host: target, Client: clientConn.RemoteAddr().String(), Started: time.Now(),
+		bytes: func() (int64, int64) { return cc.written.Load(), cc.read.Load() },
+		close: func() { clientConn.Close() }}
+	untrack := s.trackConn(lc)
+	s.stats.MITMSession(1)
+	cc.onClose = func() {
+		untrack()
+		s.stats.MITMSession(-1)
+	}
+	tlsCfg := &tls.Config{
+		GetCertificate: s.mirrorCertificate(target, cs.id, c.ip),
 		NextProtos:     []string{"h2", "http/1.1"},
-	})
+	}
+	if s.keylog != nil {
+		host, _, _ := net.SplitHostPort(target)
+		// the handshake precedes any request, so only host-wide rules apply
+		if s.cfg.KeyLog.All || rules.KeyLog(s.rules.Match(host, "", "")) {
+			tlsCfg.KeyLogWriter = s.keylog.For(cs.id, "client", host)
+		}
+	}
+	tlsSrv := tls.Server(cc, tlsCfg)
 	// serve a single connection as HTTP server
 	go func() {
-		httpSrv := &http.Server{Handler: s.mitmHandler(target)}
+		httpSrv := &http.Server{Handler: s.mitmHandler(target, c), ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, connStateKey{}, cs)
+		}}
 		_ = http2.ConfigureServer(httpSrv, &http2.Server{})
 		_ = httpSrv.Serve(&singleUseListener{Conn: tlsSrv})
 	}()
 }
 
-func (s *Server) mitmHandler(target string) http.Handler {
+func (s *Server) mitmHandler(target string, c client) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// rebuild absolute URL for reverse proxy
 		scheme := "https"
@@ -231,7 +520,7 @@ func (s *Server) mitmHandler(target string) http.Handler {
 		r.Host = r.URL.Host
 		// remove hop-by-hop
 		r.Header.Del("Proxy-Connection")
-		s.rp.ServeHTTP(w, r)
+		s.forward(w, r.WithContext(withClient(r.Context(), c)))
 	})
 }
 
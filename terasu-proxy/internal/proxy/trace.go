@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+
+	"terasu-proxy/internal/flow"
+	"terasu-proxy/internal/tracing"
+)
+
+// startSpan opens the server span of the flow f, continuing the trace of
+// the client's traceparent if it sent one.
+func (s *Server) startSpan(r *http.Request, f *flow.Flow, c client) (*http.Request, *tracing.Span) {
+	if s.tracer == nil {
+		return r, nil
+	}
+	st := f.State()
+	ctx, sp := s.tracer.Start(r.Context(), st.Method+" "+st.Host, tracing.KindServer, r.Header)
+	sp.Set("http.request.method", st.Method)
+	sp.Set("url.full", st.URL)
+	sp.Set("server.address", st.Host)
+	sp.Set("client.address", c.ip)
+	if c.user != "" {
+		sp.Set("enduser.id", c.user)
+	}
+	sp.Set("terasu.flow", st.ID)
+	if st.Conn != "" {
+		sp.Set("terasu.conn", st.Conn)
+	}
+	return r.WithContext(ctx), sp
+}
+
+// endSpan closes sp with the final state of f. It is deferred before the
+// flow is finished so that it runs after.
+func endSpan(sp *tracing.Span, f *flow.Flow) {
+	if sp == nil {
+		return
+	}
+	st := f.State()
+	if len(st.Rules) > 0 {
+		sp.Set("terasu.rules", st.Rules)
+	}
+	if st.Status != 0 {
+		sp.Set("http.response.status_code", st.Status)
+	}
+	sp.Set("http.request.body.size", st.BytesOut)
+	sp.Set("http.response.body.size", st.BytesIn)
+	if st.Error != "" {
+		sp.Fail(st.Error)
+	} else if st.Status >= 500 {
+		sp.Fail(http.StatusText(st.Status))
+	}
+	sp.End()
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"terasu-proxy/internal/egress"
+	"terasu-proxy/internal/flow"
+)
+
+// upstream_tls.on_verify_error policies
+const (
+	verifyErrorPage   = "error_page"
+	verifyErrorMirror = "mirror"
+)
+
+var verifyPage = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Upstream certificate error</title></head>
+<body>
+<h1>Upstream certificate error</h1>
+<p>terasu-proxy could not verify the certificate presented by <b>{{.Host}}</b>.</p>
+<pre>{{.Err}}</pre>
+<h2>Upstream chain</h2>
+{{range $i, $c := .Chain}}<h3>#{{$i}} {{$c.Subject}}</h3>
+<ul>
+<li>Issuer: {{$c.Issuer}}</li>
+<li>Valid: {{$c.NotBefore}} &ndash; {{$c.NotAfter}}</li>
+<li>DNS names: {{range $c.DNSNames}}{{.}} {{end}}</li>
+<li>SPKI pin: sha256/{{$c.Pin}}</li>
+</ul>
+{{else}}<p>No certificates received.</p>{{end}}
+</body></html>
+`))
+
+type chainCert struct {
+	Subject   string
+	Issuer    string
+	NotBefore string
+	NotAfter  string
+	DNSNames  []string
+	Pin       string
+}
+
+// errorHandler replaces the ReverseProxy default so that certificate
+// verification failures can be shown to intercepted clients. Flows dropped
+// at a response breakpoint reset the client connection instead.
+func (s *Server) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errFlowDropped) {
+		panic(http.ErrAbortHandler)
+	}
+	flow.From(r.Context()).Fail(err.Error())
+	cve, ok := egress.VerifyError(err)
+	if !ok {
+		s.log.Debugf("upstream %s: %v", r.URL.Host, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	s.log.Warnf("upstream %s: %v", r.URL.Host, cve)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadGateway)
+	_ = verifyPage.Execute(w, verifyPageData(r.URL.Host, cve))
+}
+
+func verifyPageData(host string, cve *tls.CertificateVerificationError) any {
+	chain := make([]chainCert, 0, len(cve.UnverifiedCertificates))
+	for _, c := range cve.UnverifiedCertificates {
+		pin := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		chain = append(chain, chainCert{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			NotBefore: c.NotBefore.UTC().Format(time.RFC3339),
+			NotAfter:  c.NotAfter.UTC().Format(time.RFC3339),
+			DNSNames:  c.DNSNames,
+			Pin:       base64.StdEncoding.EncodeToString(pin[:]),
+		})
+	}
+	return struct {
+		Host  string
+		Err   string
+		Chain []chainCert
+	}{host, cve.Error(), chain}
+}
+
+// mirrorCertificate returns the leaf to present to an intercepted client. In
+// mirror mode an untrusted leaf is served while the last dial to the
+// upstream failed verification, so the client sees the error; the request
+// that first hits the failure gets the error page. The session is then
+// published as a failed flow, since no request may follow.
+func (s *Server) mirrorCertificate(target, conn, clientIP string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if s.cfg.UpstreamTLS.OnVerifyError != verifyErrorMirror {
+			return s.store.GetCertificate(chi)
+		}
+		hostport := target
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(hostport, "443")
+		}
+		host, _, _ := net.SplitHostPort(hostport)
+		err := s.egress.VerifyFailure(hostport)
+		if err == nil {
+			return s.store.GetCertificate(chi)
+		}
+		s.log.Warnf("upstream %s: %v; serving untrusted certificate", host, err)
+		f := s.flows.Start(flow.State{Kind: flow.KindMITM, Conn: conn, Client: clientIP,
+			Method: http.MethodConnect, Host: host, URL: target})
+		f.Fail("upstream certificate: " + err.Error())
+		f.Finish()
+		name := chi.ServerName
+		if name == "" {
+			name = host
+		}
+		return s.store.UntrustedCertificate(name)
+	}
+}
@@ -0,0 +1,228 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"terasu-proxy/internal/config"
+)
+
+const defaultMaxBody = 8 << 20
+
+// defaultTypes are the media type prefixes rewritten when a rule lists none.
+var defaultTypes = []string{
+	"text/html", "text/plain", "text/css", "text/javascript", "text/xml",
+	"application/json", "application/javascript", "application/x-javascript",
+	"application/xml", "application/xhtml+xml",
+}
+
+// Body is a compiled body rewrite.
+type Body struct {
+	types   []string
+	text    bool // types are the defaults, which also cover +json and +xml
+	max     int64
+	unknown bool // also bodies of unknown length
+	reps    []replacer
+}
+
+type replacer struct {
+	re   *regexp.Regexp
+	find []byte
+	repl []byte
+}
+
+// NewBody compiles a body rewrite rule.
+func NewBody(c config.BodyRewrite) (*Body, error) {
+	b := &Body{types: c.Types, max: c.MaxSize, unknown: c.UnknownLength}
+	if len(b.types) == 0 {
+		b.types, b.text = defaultTypes, true
+	}
+	if b.max <= 0 {
+		b.max = defaultMaxBody
+	}
+	for _, r := range c.Replace {
+		if r.Find == "" {
+			return nil, fmt.Errorf("body rewrite: empty find")
+		}
+		rep := replacer{find: []byte(r.Find), repl: []byte(r.Replace)}
+		if r.Regex {
+			re, err := regexp.Compile(r.Find)
+			if err != nil {
+				return nil, fmt.Errorf("body rewrite: %w", err)
+			}
+			rep.re = re
+		}
+		b.reps = append(b.reps, rep)
+	}
+	return b, nil
+}
+
+func (b *Body) matches(mediaType string) bool {
+	for _, t := range b.types {
+		if strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return b.text && (strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml"))
+}
+
+func (b *Body) apply(p []byte) []byte {
+	for _, r := range b.reps {
+		if r.re != nil {
+			p = r.re.ReplaceAll(p, r.repl)
+		} else {
+			p = bytes.ReplaceAll(p, r.find, r.repl)
+		}
+	}
+	return p
+}
+
+// Bodies runs the rewrites that accept resp's media type over its decoded
+// body. Streaming, empty and oversized bodies, and unknown encodings, are
+// left untouched, as are bodies of unknown length unless the rule asks for
+// them. A changed body is sent unencoded with a fixed length.
+func Bodies(resp *http.Response, bs []*Body) error {
+	if streaming(resp) {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var max int64
+	var active []*Body
+	for _, b := range bs {
+		if b.matches(mediaType) && (resp.ContentLength >= 0 || b.unknown) {
+			active = append(active, b)
+			if max == 0 || b.max < max {
+				max = b.max
+			}
+		}
+	}
+	if len(active) == 0 || resp.ContentLength > max {
+		return nil
+	}
+	dec := decoder(resp.Header.Get("Content-Encoding"))
+	if dec == nil {
+		return nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(raw)) > max {
+		resp.Body = rejoin(raw, resp.Body)
+		return nil
+	}
+	// the original is closed with the replacement, once the client has it
+	orig := resp.Body
+	resp.Body = withCloser(raw, orig)
+	body, err := decode(dec, raw, max)
+	if err != nil {
+		// undecodable or too large once decoded, pass it on as received
+		return nil
+	}
+	out := body
+	for _, b := range active {
+		out = b.apply(out)
+	}
+	if bytes.Equal(out, body) {
+		return nil
+	}
+	resp.Body = withCloser(out, orig)
+	resp.ContentLength = int64(len(out))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("ETag")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
+
+// streaming reports responses that must not be buffered.
+func streaming(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusSwitchingProtocols, http.StatusNoContent, http.StatusNotModified:
+		return true
+	}
+	if resp.Body == nil || resp.Body == http.NoBody || resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+	ct := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "multipart/x-mixed-replace")
+}
+
+type decodeFunc func(io.Reader) (io.ReadCloser, error)
+
+// decoder returns the decoder of a Content-Encoding, or nil when unsupported.
+func decoder(enc string) decodeFunc {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "", "identity":
+		return func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil }
+	case "gzip", "x-gzip":
+		return func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case "deflate":
+		return zlib.NewReader
+	case "br":
+		return func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(brotli.NewReader(r)), nil }
+	case "zstd":
+		return func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}
+	}
+	return nil
+}
+
+// Decode decompresses raw according to a Content-Encoding, failing when the
+// encoding is unsupported or the result exceeds max bytes.
+func Decode(enc string, raw []byte, max int64) ([]byte, error) {
+	dec := decoder(enc)
+	if dec == nil {
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+	return decode(dec, raw, max)
+}
+
+// decode decompresses raw, failing when the result exceeds max bytes.
+func decode(dec decodeFunc, raw []byte, max int64) ([]byte, error) {
+	rc, err := dec(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	p, err := io.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) > max {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", max)
+	}
+	return p, nil
+}
+
+// withCloser serves p as a body whose Close closes c.
+func withCloser(p []byte, c io.Closer) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(p), c}
+}
+
+// rejoin puts an already read prefix back in front of the rest of a body.
+func rejoin(head []byte, rest io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), rest), rest}
+}
@@ -0,0 +1,150 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"terasu-proxy/internal/config"
+)
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// encode compresses s with a Content-Encoding.
+func encode(t *testing.T, enc, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "", "compress":
+		return []byte(s)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		t.Fatalf("unknown encoding %q", enc)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBodies(t *testing.T) {
+	const in = "hello world"
+	tests := []struct {
+		name          string
+		encoding      string
+		unknown       bool // sent without a Content-Length
+		unknownLength bool
+		maxSize       int64
+		want          string // "" when the body passes through as received
+	}{
+		{name: "known length", want: "hello proxy"},
+		{name: "unknown length skipped", unknown: true},
+		{name: "unknown length opted in", unknown: true, unknownLength: true, want: "hello proxy"},
+		{name: "gzip", encoding: "gzip", want: "hello proxy"},
+		{name: "deflate", encoding: "deflate", want: "hello proxy"},
+		{name: "br", encoding: "br", want: "hello proxy"},
+		{name: "zstd", encoding: "zstd", want: "hello proxy"},
+		{name: "unsupported encoding", encoding: "compress"},
+		{name: "above max_size", maxSize: 5},
+		{name: "unknown length above max_size", unknown: true, unknownLength: true, maxSize: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBody(config.BodyRewrite{
+				Replace:       []config.BodyReplace{{Find: "world", Replace: "proxy"}},
+				MaxSize:       tt.maxSize,
+				UnknownLength: tt.unknownLength,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := encode(t, tt.encoding, in)
+			orig := &closeRecorder{Reader: bytes.NewReader(raw)}
+			header := http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}}
+			length := int64(len(raw))
+			if tt.unknown {
+				length = -1
+			} else {
+				header.Set("Content-Length", strconv.Itoa(len(raw)))
+			}
+			if tt.encoding != "" {
+				header.Set("Content-Encoding", tt.encoding)
+			}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        header.Clone(),
+				Body:          orig,
+				ContentLength: length,
+			}
+			if err := Bodies(resp, []*Body{b}); err != nil {
+				t.Fatal(err)
+			}
+			if orig.closed {
+				t.Fatal("original body closed before the rewritten one")
+			}
+			got, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if !orig.closed {
+				t.Error("original body not closed with the rewritten one")
+			}
+			if tt.want == "" {
+				if !bytes.Equal(got, raw) {
+					t.Errorf("body = %q, want it as received", got)
+				}
+				if resp.ContentLength != length {
+					t.Errorf("ContentLength = %d, want %d", resp.ContentLength, length)
+				}
+				for k := range header {
+					if resp.Header.Get(k) != header.Get(k) {
+						t.Errorf("%s = %q, want %q", k, resp.Header.Get(k), header.Get(k))
+					}
+				}
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if resp.ContentLength != int64(len(tt.want)) {
+				t.Errorf("ContentLength = %d, want %d", resp.ContentLength, len(tt.want))
+			}
+			if v := resp.Header.Get("Content-Length"); v != strconv.Itoa(len(tt.want)) {
+				t.Errorf("Content-Length = %q, want %d", v, len(tt.want))
+			}
+			for _, k := range []string{"Content-Encoding", "Etag"} {
+				if v := resp.Header.Get(k); v != "" {
+					t.Errorf("%s = %q, want it dropped", k, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Package rewrite edits intercepted traffic according to rules.
+package rewrite
+
+import (
+	"net/http"
+	"strings"
+
+	"terasu-proxy/internal/config"
+)
+
+// Vars are the values available to rewrite templates.
+type Vars struct {
+	ClientIP string
+	User     string
+	Host     string
+	Method   string
+	Path     string
+}
+
+// Expand replaces ${name} references in s. Unknown names are kept as written.
+func (v Vars) Expand(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		if val, ok := v.lookup(s[i+2 : i+j]); ok {
+			b.WriteString(val)
+		} else {
+			b.WriteString(s[i : i+j+1])
+		}
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func (v Vars) lookup(name string) (string, bool) {
+	switch name {
+	case "client_ip":
+		return v.ClientIP, true
+	case "user":
+		return v.User, true
+	case "host":
+		return v.Host, true
+	case "method":
+		return v.Method, true
+	case "path":
+		return v.Path, true
+	}
+	return "", false
+}
+
+// Headers applies ops to h. A Host entry in Set is returned as host instead,
+// since Go sends the Host header from the request field.
+func Headers(h http.Header, ops config.HeaderOps, v Vars) (host string) {
+	for _, name := range ops.Remove {
+		h.Del(name)
+	}
+	for name, val := range ops.Set {
+		val = v.Expand(val)
+		if http.CanonicalHeaderKey(name) == "Host" {
+			host = val
+			continue
+		}
+		h.Set(name, val)
+	}
+	for name, val := range ops.Add {
+		h.Add(name, v.Expand(val))
+	}
+	return host
+}
@@ -0,0 +1,93 @@
+package rewrite
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"terasu-proxy/internal/config"
+)
+
+var testVars = Vars{ClientIP: "10.0.0.7", User: "alice", Host: "api.example.com", Method: "POST", Path: "/v1/items"}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"client_ip", "${client_ip}", "10.0.0.7"},
+		{"user", "u=${user}", "u=alice"},
+		{"host", "${host}:443", "api.example.com:443"},
+		{"method", "${method}", "POST"},
+		{"path", "${path}?x=1", "/v1/items?x=1"},
+		{"several", "${method} ${host}${path}", "POST api.example.com/v1/items"},
+		{"unknown kept", "${nope}-${user}", "${nope}-alice"},
+		{"unterminated", "a ${user", "a ${user"},
+		{"no reference", "plain", "plain"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testVars.Expand(tt.in); got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       http.Header
+		ops      config.HeaderOps
+		want     http.Header
+		wantHost string
+	}{
+		{
+			name: "add appends",
+			in:   http.Header{"Via": {"1.1 a"}},
+			ops:  config.HeaderOps{Add: map[string]string{"via": "1.1 ${host}"}},
+			want: http.Header{"Via": {"1.1 a", "1.1 api.example.com"}},
+		},
+		{
+			name: "remove",
+			in:   http.Header{"Cookie": {"a=1"}, "Accept": {"*/*"}},
+			ops:  config.HeaderOps{Remove: []string{"cookie"}},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "set replaces",
+			in:   http.Header{"X-User": {"mallory", "eve"}},
+			ops:  config.HeaderOps{Set: map[string]string{"X-User": "${user}"}},
+			want: http.Header{"X-User": {"alice"}},
+		},
+		{
+			name: "remove runs before set and add",
+			in:   http.Header{"X-Client": {"old"}},
+			ops: config.HeaderOps{
+				Remove: []string{"X-Client"},
+				Set:    map[string]string{"X-Client": "${client_ip}"},
+				Add:    map[string]string{"X-Client": "${method}"},
+			},
+			want: http.Header{"X-Client": {"10.0.0.7", "POST"}},
+		},
+		{
+			name:     "host is returned",
+			in:       http.Header{},
+			ops:      config.HeaderOps{Set: map[string]string{"host": "internal.${host}"}},
+			want:     http.Header{},
+			wantHost: "internal.api.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.in.Clone()
+			host := Headers(h, tt.ops, testVars)
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("headers = %v, want %v", h, tt.want)
+			}
+			if host != tt.wantHost {
+				t.Errorf("host = %q, want %q", host, tt.wantHost)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package rules
 import (
     "net"
     "strings"
+
+    "terasu-proxy/internal/config"
 )
 
 type Mode string
@@ -15,18 +17,44 @@ const (
 type Engine struct {
     Mode    Mode
     Suffix  []string
+    Rules   []*Rule
+}
+
+// Rule is a config.Rule with its match normalized for lookups.
+type Rule struct {
+    config.Rule
+    hosts   []string
+    paths   []string
+    methods []string
 }
 
-func New(mode string, list []string) *Engine {
+func New(mode string, list []string, rs []config.Rule) *Engine {
     e := &Engine{Mode: Mode(mode)}
+    e.Suffix = normalize(list, strings.ToLower)
+    for _, rc := range rs {
+        e.Rules = append(e.Rules, &Rule{
+            Rule:    rc,
+            hosts:   normalize(rc.Match.Hosts, strings.ToLower),
+            paths:   normalize(rc.Match.Paths, nil),
+            methods: normalize(rc.Match.Methods, strings.ToUpper),
+        })
+    }
+    return e
+}
+
+func normalize(list []string, fn func(string) string) []string {
+    var out []string
     for _, d := range list {
-        s := strings.ToLower(strings.TrimSpace(d))
+        s := strings.TrimSpace(d)
+        if fn != nil {
+            s = fn(s)
+        }
         if s == "" {
             continue
         }
-        e.Suffix = append(e.Suffix, s)
+        out = append(out, s)
     }
-    return e
+    return out
 }
 
 // ShouldIntercept decides whether a host:port should be MITM-ed.
@@ -40,15 +68,180 @@ func (e *Engine) ShouldIntercept(hostport string) bool {
     case ModeAll:
         return true
     case ModeList:
-        for _, suf := range e.Suffix {
-            if host == suf || strings.HasSuffix(host, "."+suf) {
-                return true
-            }
-        }
-        return false
+        return HostMatches(host, e.Suffix)
     default:
         return false
     }
 }
 
+// Match returns the rules matching a request in config order. An empty path
+// or method (e.g. for CONNECT tunnels) only matches rules that do not
+// constrain it.
+func (e *Engine) Match(host, path, method string) []*Rule {
+    var out []*Rule
+    for _, r := range e.Rules {
+        if r.Matches(host, path, method) {
+            out = append(out, r)
+        }
+    }
+    return out
+}
+
+// Matches reports whether the rule applies to a request.
+func (r *Rule) Matches(host, path, method string) bool {
+    if len(r.hosts) > 0 && !HostMatches(host, r.hosts) {
+        return false
+    }
+    if len(r.methods) > 0 {
+        ok := false
+        for _, m := range r.methods {
+            if m == method {
+                ok = true
+                break
+            }
+        }
+        if !ok {
+            return false
+        }
+    }
+    if len(r.paths) > 0 {
+        ok := false
+        for _, p := range r.paths {
+            if path != "" && strings.HasPrefix(path, p) {
+                ok = true
+                break
+            }
+        }
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// Rest returns path below the longest matching path prefix of the rule,
+// starting with "/". Rules without paths return path itself.
+func (r *Rule) Rest(path string) string {
+    best := ""
+    for _, p := range r.paths {
+        if strings.HasPrefix(path, p) && len(p) > len(best) {
+            best = p
+        }
+    }
+    rest := strings.TrimPrefix(path, best)
+    if !strings.HasPrefix(rest, "/") {
+        rest = "/" + rest
+    }
+    return rest
+}
+
+// Parents returns the parent proxy list of the first matching rule that sets one.
+func Parents(rs []*Rule) []string {
+    for _, r := range rs {
+        if len(r.Rule.Parents) > 0 {
+            return r.Rule.Parents
+        }
+    }
+    return nil
+}
+
+// Upstream returns the upstream override of the first matching rule that sets one.
+func Upstream(rs []*Rule) *config.UpstreamOverride {
+    return first(rs, func(r *config.Rule) *config.UpstreamOverride { return r.Upstream })
+}
+
+// HTTPFragment returns the plain-HTTP fragmentation settings of the first
+// matching rule that sets them.
+func HTTPFragment(rs []*Rule) *config.HTTPFragment {
+    return first(rs, func(r *config.Rule) *config.HTTPFragment { return r.HTTPFragment })
+}
+
+// Fault returns the fault injection settings of the first matching rule that
+// sets them.
+func Fault(rs []*Rule) *config.Fault {
+    return first(rs, func(r *config.Rule) *config.Fault { return r.Fault })
+}
 
+// Breakpoint returns the breakpoint of the first matching rule that sets one.
+func Breakpoint(rs []*Rule) *config.Breakpoint {
+    return first(rs, func(r *config.Rule) *config.Breakpoint { return r.Breakpoint })
+}
+
+// Capture reports whether any matching rule records the exchange.
+func Capture(rs []*Rule) bool {
+    return firstRule(rs, func(r *config.Rule) bool { return r.Capture }) != nil
+}
+
+// KeyLog reports whether any matching rule logs TLS secrets.
+func KeyLog(rs []*Rule) bool {
+    return firstRule(rs, func(r *config.Rule) bool { return r.KeyLog }) != nil
+}
+
+// Mock returns the first matching rule with a canned response.
+func Mock(rs []*Rule) *Rule {
+    return firstRule(rs, func(r *config.Rule) bool { return r.Mock != nil })
+}
+
+// MapLocal returns the first matching rule that maps to local files.
+func MapLocal(rs []*Rule) *Rule {
+    return firstRule(rs, func(r *config.Rule) bool { return r.MapLocal != nil })
+}
+
+// MapRemote returns the first matching rule that maps to another upstream.
+func MapRemote(rs []*Rule) *Rule {
+    return firstRule(rs, func(r *config.Rule) bool { return r.MapRemote != nil })
+}
+
+// Headers returns the header rewrites of all matching rules, in rule order.
+func Headers(rs []*Rule) []*config.HeaderRewrite {
+    var out []*config.HeaderRewrite
+    for _, r := range rs {
+        if r.Rule.Headers != nil {
+            out = append(out, r.Rule.Headers)
+        }
+    }
+    return out
+}
+
+// Bodies returns the body rewrites of all matching rules, in rule order.
+func Bodies(rs []*Rule) []*config.BodyRewrite {
+    var out []*config.BodyRewrite
+    for _, r := range rs {
+        if r.Rule.Body != nil {
+            out = append(out, r.Rule.Body)
+        }
+    }
+    return out
+}
+
+// first returns the first non-nil action picked by get from the matched rules.
+func first[T any](rs []*Rule, get func(*config.Rule) *T) *T {
+    for _, r := range rs {
+        if v := get(&r.Rule); v != nil {
+            return v
+        }
+    }
+    return nil
+}
+
+// firstRule returns the first matched rule accepted by has.
+func firstRule(rs []*Rule, has func(*config.Rule) bool) *Rule {
+    for _, r := range rs {
+        if has(&r.Rule) {
+            return r
+        }
+    }
+    return nil
+}
+
+// HostMatches reports whether host equals or is a subdomain of any suffix.
+// Suffixes are expected in lower case; "*" matches every host.
+func HostMatches(host string, suffixes []string) bool {
+    host = strings.ToLower(host)
+    for _, suf := range suffixes {
+        if suf == "*" || host == suf || strings.HasSuffix(host, "."+suf) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"terasu-proxy/internal/config"
+)
+
+const (
+	exportEvery = 5 * time.Second
+	exportBatch = 512
+	exportQueue = 2048
+)
+
+// otlpSpan is a span in the OTLP/JSON encoding: ids in hex, times as
+// strings of unix nanoseconds.
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         Kind       `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+func (s *Span) export(end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.trace[:]),
+		SpanID:  hex.EncodeToString(s.id[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttr{a.key, s.t.value(a)})
+	}
+	if s.err != "" {
+		o.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
+
+// value encodes an attribute value, hiding the redacted ones.
+func (t *Tracer) value(a attr) map[string]any {
+	if t.redact[a.key] {
+		return map[string]any{"stringValue": "[redacted]"}
+	}
+	switch v := a.val.(type) {
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	case string:
+		return map[string]any{"stringValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// exporter queues finished spans and posts them in batches. Spans arriving
+// while the queue is full are dropped.
+type exporter struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+	log     *logrus.Logger
+
+	mu     sync.RWMutex // guards closed against sends on ch
+	closed bool
+	ch     chan otlpSpan
+	done   chan struct{}
+}
+
+func newExporter(cfg config.Tracing, log *logrus.Logger) *exporter {
+	e := &exporter{
+		url:     strings.TrimRight(cfg.Endpoint, "/") + "/v1/traces",
+		headers: cfg.Headers,
+		service: cfg.ServiceName,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		log:     log,
+		ch:      make(chan otlpSpan, exportQueue),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) add(s otlpSpan) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.ch <- s:
+	default:
+		e.log.Debugf("tracing: queue full, span %s dropped", s.Name)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	tick := time.NewTicker(exportEvery)
+	defer tick.Stop()
+	batch := make([]otlpSpan, 0, exportBatch)
+	flush := func() {
+		if len(batch) > 0 {
+			e.post(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case s, ok := <-e.ch:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= exportBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// close stops accepting spans and waits for the last batch to be posted.
+func (e *exporter) close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.ch)
+	}
+	e.mu.Unlock()
+	<-e.done
+}
+
+func (e *exporter) post(spans []otlpSpan) {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttr{
+				{"service.name", map[string]any{"stringValue": e.service}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "terasu-proxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		e.log.Warnf("tracing: encode: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		e.log.Warnf("tracing: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.log.Warnf("tracing: export %d spans: %v", len(spans), err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.log.Warnf("tracing: export %d spans: collector answered %s", len(spans), resp.Status)
+	}
+}
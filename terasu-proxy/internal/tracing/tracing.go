@@ -0,0 +1,223 @@
+// Package tracing records spans for proxied requests and exports them to an
+// OpenTelemetry collector over OTLP/HTTP with JSON encoding.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"terasu-proxy/internal/config"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// Tracer starts spans and hands finished, sampled ones to the exporter. A
+// nil Tracer starts no spans.
+type Tracer struct {
+	ratio     float64
+	propagate bool
+	redact    map[string]bool
+	exp       *exporter
+}
+
+// New returns a tracer exporting to cfg.Endpoint, or nil when tracing is off.
+func New(cfg config.Tracing, log *logrus.Logger) *Tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	t := &Tracer{ratio: cfg.SampleRatio, propagate: cfg.Propagate, redact: make(map[string]bool)}
+	for _, k := range cfg.Redact {
+		t.redact[k] = true
+	}
+	t.exp = newExporter(cfg, log)
+	return t
+}
+
+// Close exports the spans still queued.
+func (t *Tracer) Close() {
+	if t != nil {
+		t.exp.close()
+	}
+}
+
+// Span is one operation. Its methods are no-ops on a nil Span.
+type Span struct {
+	t       *Tracer
+	trace   TraceID
+	id      SpanID
+	parent  SpanID
+	sampled bool
+	name    string
+	kind    Kind
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs []attr
+	err   string
+	ended bool
+}
+
+type attr struct {
+	key string
+	val any // string, int64, float64 or bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span under the span of ctx, or else under the W3C
+// traceparent of h, or else as the root of a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, h http.Header) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{t: t, name: name, kind: kind, start: time.Now()}
+	if p := FromContext(ctx); p != nil {
+		s.trace, s.parent, s.sampled = p.trace, p.id, p.sampled
+	} else if tid, pid, sampled, ok := parseTraceparent(h.Get("Traceparent")); ok {
+		s.trace, s.parent, s.sampled = tid, pid, sampled
+	} else {
+		_, _ = rand.Read(s.trace[:])
+		s.sampled = t.sample(s.trace)
+	}
+	_, _ = rand.Read(s.id[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample keeps a ratio of new traces, decided by the trace id so that it
+// is stable for the whole trace.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11)/(1<<53) < t.ratio
+}
+
+// Child begins a span under the span of ctx; without one it returns nil.
+func Child(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	p := FromContext(ctx)
+	if p == nil {
+		return ctx, nil
+	}
+	return p.t.Start(ctx, name, kind, nil)
+}
+
+// Record adds a finished internal span from start until now under the span
+// of ctx, for phases measured after the fact.
+func Record(ctx context.Context, name string, start time.Time, err error, kv ...any) {
+	_, s := Child(ctx, name, KindInternal)
+	if s == nil {
+		return
+	}
+	s.start = start
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.Set(kv[i].(string), kv[i+1])
+	}
+	if err != nil {
+		s.Fail(err.Error())
+	}
+	s.End()
+}
+
+// Set adds an attribute; ints are stored as int64.
+func (s *Span) Set(key string, v any) {
+	if s == nil || !s.sampled {
+		return
+	}
+	switch x := v.(type) {
+	case int:
+		v = int64(x)
+	case uint64:
+		v = int64(x)
+	case []string:
+		v = strings.Join(x, ",")
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attr{key, v})
+	s.mu.Unlock()
+}
+
+// Fail marks the span as failed; the first message is kept.
+func (s *Span) Fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.err == "" {
+		s.err = msg
+	}
+	s.mu.Unlock()
+}
+
+// End finishes the span once and queues it for export when sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	if s.sampled {
+		s.t.exp.add(s.export(time.Now()))
+	}
+}
+
+// Traceparent returns the W3C traceparent naming this span as the parent.
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.trace[:]) + "-" + hex.EncodeToString(s.id[:]) + "-" + flags
+}
+
+// parseTraceparent reads a version 00 W3C traceparent header.
+func parseTraceparent(v string) (tid TraceID, pid SpanID, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil || tid == (TraceID{}) {
+		return
+	}
+	if _, err := hex.Decode(pid[:], []byte(parts[2])); err != nil || pid == (SpanID{}) {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	return tid, pid, flags[0]&1 == 1, true
+}
@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"io"
+	"net/http"
+)
+
+// Transport records a client span per upstream attempt under the span of
+// the request context and, when propagation is on, passes its traceparent
+// upstream. Requests without a span go straight to Base.
+type Transport struct {
+	Base http.RoundTripper
+	// Classify names the class of a round trip error for error.type.
+	Classify func(error) string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, sp := Child(req.Context(), "upstream "+req.Method, KindClient)
+	if sp == nil {
+		return t.Base.RoundTrip(req)
+	}
+	sp.Set("http.request.method", req.Method)
+	sp.Set("url.full", req.URL.String())
+	sp.Set("server.address", req.URL.Hostname())
+	if sp.t.propagate {
+		req = req.Clone(ctx)
+		req.Header.Set("Traceparent", sp.Traceparent())
+		req.Header.Del("Tracestate")
+	} else {
+		req = req.WithContext(ctx)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		if t.Classify != nil {
+			sp.Set("error.type", t.Classify(err))
+		}
+		sp.Fail(err.Error())
+		sp.End()
+		return nil, err
+	}
+	sp.Set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		sp.Fail(resp.Status)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		sp.End()
+		return resp, nil
+	}
+	// the span covers the transfer of the body too
+	resp.Body = &endingBody{ReadCloser: resp.Body, sp: sp}
+	return resp, nil
+}
+
+type endingBody struct {
+	io.ReadCloser
+	sp *Span
+	n  int64
+}
+
+func (b *endingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *endingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.sp.Set("http.response.body.size", b.n)
+	b.sp.End()
+	return err
+}